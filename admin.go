@@ -0,0 +1,352 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(new(adminAPI))
+}
+
+// adminAPI is a module that serves the /ngrok/ endpoints of the Caddy admin
+// API, listing the ngrok sessions and tunnels opened by the listener wrappers
+// and letting operators restart or close them.
+type adminAPI struct {
+	l *zap.Logger
+}
+
+// sessionStatus describes an ngrok session in the admin API
+type sessionStatus struct {
+	ID        string    `json:"id"`
+	Region    string    `json:"region,omitempty"`
+	Server    string    `json:"server,omitempty"`
+	Metadata  string    `json:"metadata,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	Tunnels   int       `json:"tunnels"`
+
+	Connected        bool   `json:"connected"`
+	HeartbeatLatency string `json:"heartbeat_latency,omitempty"`
+}
+
+// tunnelStatus describes an ngrok tunnel in the admin API
+type tunnelStatus struct {
+	ID          string            `json:"id"`
+	URL         string            `json:"url,omitempty"`
+	Proto       string            `json:"proto,omitempty"`
+	ForwardsTo  string            `json:"forwards_to,omitempty"`
+	Metadata    string            `json:"metadata,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Region      string            `json:"region,omitempty"`
+	SessionID   string            `json:"session_id"`
+	StartedAt   time.Time         `json:"started_at"`
+	Connections connectionCounts  `json:"connections"`
+}
+
+type connectionCounts struct {
+	Accepted int64 `json:"accepted"`
+	Active   int64 `json:"active"`
+}
+
+// CaddyModule implements caddy.Module
+func (*adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "admin.api.ngrok",
+		New: func() caddy.Module {
+			return new(adminAPI)
+		},
+	}
+}
+
+// Provision implements caddy.Provisioner
+func (a *adminAPI) Provision(ctx caddy.Context) error {
+	a.l = ctx.Logger()
+	return nil
+}
+
+// Routes implements caddy.AdminRouter
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/ngrok/sessions",
+			Handler: caddy.AdminHandlerFunc(a.handleSessions),
+		},
+		{
+			Pattern: "/ngrok/sessions/",
+			Handler: caddy.AdminHandlerFunc(a.handleSession),
+		},
+		{
+			Pattern: "/ngrok/tunnels",
+			Handler: caddy.AdminHandlerFunc(a.handleTunnels),
+		},
+		{
+			Pattern: "/ngrok/tunnels/",
+			Handler: caddy.AdminHandlerFunc(a.handleTunnel),
+		},
+	}
+}
+
+func (*adminAPI) handleSessions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	tunnelsPerSession := map[string]int{}
+	for _, tun := range pooledTunnels() {
+		tunnelsPerSession[tun.session().key]++
+	}
+
+	results := []sessionStatus{}
+	for _, sess := range pooledSessions() {
+		results = append(results, newSessionStatus(sess, tunnelsPerSession[sess.key]))
+	}
+
+	return writeJSON(w, results)
+}
+
+// handleSession serves POST /ngrok/sessions/{id}/reconnect, optionally with
+// a region query parameter to move the session to another region
+func (a *adminAPI) handleSession(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ngrok/sessions/"), "/")
+	if action != "reconnect" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown session action %q", action),
+		}
+	}
+
+	var sess *session
+	for _, s := range pooledSessions() {
+		if s.id == id {
+			sess = s
+			break
+		}
+	}
+	if sess == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("session %q not found", id),
+		}
+	}
+
+	if r.URL.Query().Has("region") {
+		region := r.URL.Query().Get("region")
+		if region == "" {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("the region must not be empty"),
+			}
+		}
+
+		moved, err := sess.relocate(r.Context(), region)
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("moving session %s to region %s: %v", id, region, err),
+			}
+		}
+
+		a.l.Info("ngrok session moved to another region",
+			zap.String("session_id", id),
+			zap.String("new_session_id", moved.id),
+			zap.String("region", region),
+		)
+
+		return writeJSON(w, newSessionStatus(moved, len(sessionTunnels(moved.key))))
+	}
+
+	if err := sess.reconnect(); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("reconnecting session %s: %v", id, err),
+		}
+	}
+
+	a.l.Info("ngrok session reconnecting", zap.String("session_id", id))
+
+	return writeJSON(w, newSessionStatus(sess, len(sessionTunnels(sess.key))))
+}
+
+func (*adminAPI) handleTunnels(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	results := []tunnelStatus{}
+	for _, tun := range pooledTunnels() {
+		results = append(results, newTunnelStatus(tun))
+	}
+
+	return writeJSON(w, results)
+}
+
+// handleTunnel serves POST /ngrok/tunnels/{id}/restart and
+// POST /ngrok/tunnels/{id}/close
+func (a *adminAPI) handleTunnel(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/ngrok/tunnels/"), "/")
+	if action != "restart" && action != "close" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown tunnel action %q", action),
+		}
+	}
+
+	var tun *sharedTunnel
+	for _, t := range pooledTunnels() {
+		if t.ID() == id {
+			tun = t
+			break
+		}
+	}
+	if tun == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("tunnel %q not found", id),
+		}
+	}
+
+	switch action {
+	case "restart":
+		if err := tun.restart(r.Context()); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("restarting tunnel %s: %v", id, err),
+			}
+		}
+
+		a.l.Info("ngrok tunnel restarted", zap.String("previous_id", id), zap.String("id", tun.ID()), zap.String("url", tun.URL()))
+		tun.events.emit(eventTunnelStarted, tun.eventData(nil))
+
+	case "close":
+		closed, err := tun.retire()
+		if err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusInternalServerError,
+				Err:        fmt.Errorf("closing tunnel %s: %v", id, err),
+			}
+		}
+
+		if closed {
+			a.l.Info("ngrok tunnel closed", zap.String("id", id), zap.String("url", tun.URL()))
+			tun.events.emit(eventTunnelClosed, tun.eventData(nil))
+		}
+	}
+
+	return writeJSON(w, newTunnelStatus(tun))
+}
+
+func newSessionStatus(sess *session, tunnels int) sessionStatus {
+	status := sessionStatus{
+		ID:        sess.id,
+		Region:    sess.region,
+		Server:    sess.server,
+		Metadata:  sess.metadata,
+		StartedAt: sess.startedAt,
+		Tunnels:   tunnels,
+		Connected: sess.connected.Load(),
+	}
+
+	if latency := sess.heartbeatLatency.Load(); latency > 0 {
+		status.HeartbeatLatency = time.Duration(latency).String()
+	}
+
+	return status
+}
+
+func newTunnelStatus(tun *sharedTunnel) tunnelStatus {
+	sess := tun.session()
+
+	return tunnelStatus{
+		ID:         tun.ID(),
+		URL:        tun.URL(),
+		Proto:      tun.Proto(),
+		ForwardsTo: tun.ForwardsTo(),
+		Metadata:   tun.Metadata(),
+		Labels:     tun.Labels(),
+		Region:     sess.region,
+		SessionID:  sess.id,
+		StartedAt:  tun.startedAt,
+		Connections: connectionCounts{
+			Accepted: tun.acceptedConns.Load(),
+			Active:   tun.activeConns.Load(),
+		},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	return nil
+}
+
+// pooledSessions returns the established sessions, oldest first
+func pooledSessions() []*session {
+	var all []*session
+	sessions.Range(func(_, val any) bool {
+		// the value is nil while the session is being established
+		if sess, ok := val.(*session); ok {
+			all = append(all, sess)
+		}
+		return true
+	})
+
+	sort.Slice(all, func(i, j int) bool { return all[i].startedAt.Before(all[j].startedAt) })
+
+	return all
+}
+
+// pooledTunnels returns the open tunnels, oldest first
+func pooledTunnels() []*sharedTunnel {
+	var all []*sharedTunnel
+	tunnels.Range(func(_, val any) bool {
+		// the value is nil while the tunnel is being opened
+		if tun, ok := val.(*sharedTunnel); ok {
+			all = append(all, tun)
+		}
+		return true
+	})
+
+	sort.Slice(all, func(i, j int) bool { return all[i].startedAt.Before(all[j].startedAt) })
+
+	return all
+}
+
+var (
+	_ caddy.Module      = (*adminAPI)(nil)
+	_ caddy.Provisioner = (*adminAPI)(nil)
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,267 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// adminRequest serves req with the route of the ngrok admin API matching it,
+// picking the routes the way the admin server does.
+func adminRequest(t *testing.T, req *http.Request) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	api := new(adminAPI)
+	require.Nil(t, api.Provision(newTestContext(t)))
+
+	mux := http.NewServeMux()
+	for _, route := range api.Routes() {
+		mux.Handle(route.Pattern, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	}
+
+	_, pattern := mux.Handler(req)
+	for _, route := range api.Routes() {
+		if route.Pattern == pattern {
+			rec := httptest.NewRecorder()
+			return rec, route.Handler.ServeHTTP(rec, req)
+		}
+	}
+
+	t.Fatalf("no admin route for %s", req.URL.Path)
+	return nil, nil
+}
+
+func serveAdmin[T any](t *testing.T, method, path string) T {
+	t.Helper()
+
+	rec, err := adminRequest(t, httptest.NewRequest(method, path, nil))
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var res T
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+	return res
+}
+
+func getAdmin[T any](t *testing.T, path string) T {
+	t.Helper()
+
+	return serveAdmin[T](t, http.MethodGet, path)
+}
+
+func TestAdminList(t *testing.T) {
+	sess := withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "admin-list-test", Region: "eu", Metadata: "caddy"}
+	provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+	tun := sess.last.Load()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	_, client := tun.dial()
+	defer client.Close()
+	conn := <-accepted
+
+	sessionID := n.shared.session().id
+
+	var listedSession *sessionStatus
+	for _, s := range getAdmin[[]sessionStatus](t, "/ngrok/sessions") {
+		if s.ID == sessionID {
+			listedSession = &s
+		}
+	}
+	require.NotNil(t, listedSession)
+	require.Equal(t, "eu", listedSession.Region)
+	require.Equal(t, "caddy", listedSession.Metadata)
+	require.Equal(t, 1, listedSession.Tunnels)
+	require.False(t, listedSession.StartedAt.IsZero())
+	require.True(t, listedSession.Connected)
+
+	var listedTunnel *tunnelStatus
+	for _, tt := range getAdmin[[]tunnelStatus](t, "/ngrok/tunnels") {
+		if tt.SessionID == sessionID {
+			listedTunnel = &tt
+		}
+	}
+	require.NotNil(t, listedTunnel)
+	require.Equal(t, "tn_fake", listedTunnel.ID)
+	require.Equal(t, "https://fake.ngrok.app", listedTunnel.URL)
+	require.Equal(t, "https", listedTunnel.Proto)
+	require.Equal(t, "eu", listedTunnel.Region)
+	require.Equal(t, connectionCounts{Accepted: 1, Active: 1}, listedTunnel.Connections)
+
+	require.Nil(t, conn.Close())
+
+	for _, tt := range getAdmin[[]tunnelStatus](t, "/ngrok/tunnels") {
+		if tt.SessionID == sessionID {
+			require.Equal(t, connectionCounts{Accepted: 1, Active: 0}, tt.Connections)
+		}
+	}
+}
+
+func TestAdminTunnelRestart(t *testing.T) {
+	sess := withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "admin-restart-test"}
+	provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+	oldTun := sess.last.Load()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	res := serveAdmin[tunnelStatus](t, http.MethodPost, "/ngrok/tunnels/tn_fake/restart")
+	require.Equal(t, n.shared.session().id, res.SessionID)
+
+	require.EqualValues(t, 2, sess.listens.Load())
+	require.True(t, oldTun.isClosed())
+
+	// the pending Accept is served by the new tunnel
+	_, client := sess.last.Load().dial()
+	defer client.Close()
+	conn := <-accepted
+	require.NotNil(t, conn)
+	require.Nil(t, conn.Close())
+}
+
+func TestAdminTunnelClose(t *testing.T) {
+	sess := withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "admin-close-test"}
+	provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+
+	serveAdmin[tunnelStatus](t, http.MethodPost, "/ngrok/tunnels/tn_fake/close")
+	closed := sess.last.Load()
+	require.True(t, closed.isClosed())
+
+	_, err := ln.Accept()
+	require.NotNil(t, err)
+
+	// the next config reload opens the tunnel again
+	reloaded := &Ngrok{AuthToken: "admin-close-test"}
+	provisionNgrok(t, reloaded)
+	require.NotSame(t, n.shared, reloaded.shared)
+	require.EqualValues(t, 2, sess.listens.Load())
+
+	reloadedLn := reloaded.WrapListener(nil)
+	go sess.last.Load().dial()
+	conn, err := reloadedLn.Accept()
+	require.Nil(t, err)
+	require.Nil(t, conn.Close())
+}
+
+func TestAdminSessionReconnect(t *testing.T) {
+	withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "admin-reconnect-test"}
+	provisionNgrok(t, n)
+
+	sess := n.shared.session()
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	sess.dialer.conn = conn
+
+	res := serveAdmin[sessionStatus](t, http.MethodPost, "/ngrok/sessions/"+sess.id+"/reconnect")
+	require.Equal(t, sess.id, res.ID)
+	require.Equal(t, 1, res.Tunnels)
+
+	_, err := remote.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestAdminSessionRelocate(t *testing.T) {
+	connected := withSessionPerConnect(t)
+
+	n := &Ngrok{AuthToken: "admin-relocate-test", Region: "us"}
+	provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+	oldSess := n.shared.session()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	res := serveAdmin[sessionStatus](t, http.MethodPost, "/ngrok/sessions/"+oldSess.id+"/reconnect?region=eu")
+	require.NotEqual(t, oldSess.id, res.ID)
+	require.Equal(t, "eu", res.Region)
+	require.Equal(t, 1, res.Tunnels)
+
+	require.Equal(t, "eu", getAdmin[[]tunnelStatus](t, "/ngrok/tunnels")[0].Region)
+
+	// the previous session is closed once its tunnel is moved
+	require.Len(t, connected(), 2)
+	require.True(t, connected()[0].isClosed())
+	require.True(t, connected()[0].last.Load().isClosed())
+
+	// the pending Accept is served by the tunnel of the new session
+	_, client := connected()[1].last.Load().dial()
+	defer client.Close()
+	conn := <-accepted
+	require.NotNil(t, conn)
+	require.Nil(t, conn.Close())
+
+	// a reload of the same config keeps the moved tunnel
+	reloaded := &Ngrok{AuthToken: "admin-relocate-test", Region: "us"}
+	provisionNgrok(t, reloaded)
+	require.Same(t, n.shared, reloaded.shared)
+	require.Len(t, connected(), 2)
+
+	// the session is re-keyed as if the region were configured, so a config
+	// with that region shares it
+	inRegion := &Ngrok{AuthToken: "admin-relocate-test", Region: "eu", TunnelRaw: []byte(`{"type":"tcp"}`)}
+	provisionNgrok(t, inRegion)
+	require.Same(t, n.shared.session(), inRegion.shared.session())
+	require.Len(t, connected(), 2)
+}
+
+func TestAdminErrors(t *testing.T) {
+	withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "admin-errors-test"}
+	provisionNgrok(t, n)
+	sess := n.shared.session()
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodPost, "/ngrok/sessions", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/ngrok/tunnels", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/ngrok/tunnels/tn_fake/restart", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/ngrok/sessions/abc/reconnect", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/ngrok/tunnels/tn_missing/restart", http.StatusNotFound},
+		{http.MethodPost, "/ngrok/tunnels/tn_fake/stop", http.StatusNotFound},
+		{http.MethodPost, "/ngrok/sessions/missing/reconnect", http.StatusNotFound},
+		{http.MethodPost, "/ngrok/sessions/missing/close", http.StatusNotFound},
+		{http.MethodPost, "/ngrok/sessions/" + sess.id + "/reconnect?region=", http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			_, err := adminRequest(t, httptest.NewRequest(tc.method, tc.path, nil))
+
+			var apiErr caddy.APIError
+			require.ErrorAs(t, err, &apiErr)
+			require.Equal(t, tc.status, apiErr.HTTPStatus)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package ngroklistener
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// storage returns the storage the auth token is loaded from; swapped in tests
+var storage = caddy.Context.Storage
+
+// provisionAuthToken loads the auth token from the `auth_token_file` or the
+// Caddy storage. It is loaded again on every config load, so that a rotated
+// token is picked up by a reload. The token is only kept in memory, and never
+// written back to the config.
+func (n *Ngrok) provisionAuthToken(ctx caddy.Context) error {
+	token, err := resolveSecret(n.AuthToken)
+	if err != nil {
+		return fmt.Errorf("resolving auth_token: %v", err)
+	}
+	n.AuthToken = token
+
+	sources := 0
+	for _, source := range []string{n.AuthToken, n.AuthTokenFile, n.AuthTokenStorage} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("only one of auth_token, auth_token_file and auth_token_storage may be set")
+	}
+
+	var raw []byte
+	switch {
+	case n.AuthTokenFile != "":
+		raw, err = os.ReadFile(n.AuthTokenFile)
+		if err != nil {
+			return fmt.Errorf("reading auth_token_file: %v", err)
+		}
+	case n.AuthTokenStorage != "":
+		raw, err = storage(ctx).Load(ctx, n.AuthTokenStorage)
+		if err != nil {
+			return fmt.Errorf("loading auth_token_storage: %v", err)
+		}
+	default:
+		return nil
+	}
+
+	n.AuthToken = strings.TrimSpace(string(raw))
+	if n.AuthToken == "" {
+		return errors.New("the loaded auth token is empty")
+	}
+
+	return nil
+}
+
+func (n *Ngrok) unmarshalAuthTokenFile(d *caddyfile.Dispenser) error {
+	if !d.AllArgs(&n.AuthTokenFile) {
+		return d.ArgErr()
+	}
+
+	return nil
+}
+
+func (n *Ngrok) unmarshalAuthTokenStorage(d *caddyfile.Dispenser) error {
+	if !d.AllArgs(&n.AuthTokenStorage) {
+		return d.ArgErr()
+	}
+
+	return nil
+}
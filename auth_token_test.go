@@ -0,0 +1,121 @@
+package ngroklistener
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNgrokAuthTokenSources(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "authtoken")
+	require.Nil(t, os.WriteFile(tokenFile, []byte("from-file\n"), 0o600))
+
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "auth_token_file",
+			caddyInput: `ngrok {
+				auth_token_file ` + tokenFile + `
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, tokenFile, actual.AuthTokenFile)
+				require.Empty(t, actual.AuthToken)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "from-file", actual.AuthToken)
+			},
+		},
+		{
+			name: "auth_token_file-no-arg",
+			caddyInput: `ngrok {
+				auth_token_file
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "auth_token_file-missing",
+			caddyInput: `ngrok {
+				auth_token_file ` + filepath.Join(t.TempDir(), "missing") + `
+			}`,
+			expectConfig:       func(t *testing.T, actual *Ngrok) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "auth_token_storage",
+			caddyInput: `ngrok {
+				auth_token_storage ngrok/authtoken
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, "ngrok/authtoken", actual.AuthTokenStorage)
+			},
+			expectProvisionErr: true,
+		},
+		{
+			name: "auth_token_storage-too-many-arg",
+			caddyInput: `ngrok {
+				auth_token_storage foo bar
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "both-auth_token-and-auth_token_file",
+			caddyInput: `ngrok {
+				auth_token foo
+				auth_token_file ` + tokenFile + `
+			}`,
+			expectConfig:       func(t *testing.T, actual *Ngrok) {},
+			expectProvisionErr: true,
+		},
+	}
+
+	// the storage is empty
+	withStorage(t)
+
+	cases.runAll(t)
+}
+
+// withStorage makes the auth token be loaded from a file storage in a
+// temporary directory, returning that storage
+func withStorage(t *testing.T) certmagic.Storage {
+	orig := storage
+	t.Cleanup(func() { storage = orig })
+
+	stor := &certmagic.FileStorage{Path: t.TempDir()}
+	storage = func(caddy.Context) certmagic.Storage { return stor }
+
+	return stor
+}
+
+func TestAuthTokenStorage(t *testing.T) {
+	stor := withStorage(t)
+	require.Nil(t, stor.Store(context.Background(), "ngrok/authtoken", []byte("from-storage")))
+
+	n := &Ngrok{AuthTokenStorage: "ngrok/authtoken"}
+	provisionNgrok(t, n)
+
+	require.Equal(t, "from-storage", n.AuthToken)
+}
+
+func TestAuthTokenFileReload(t *testing.T) {
+	withSessionPerConnect(t)
+
+	tokenFile := filepath.Join(t.TempDir(), "authtoken")
+	require.Nil(t, os.WriteFile(tokenFile, []byte("first"), 0o600))
+
+	first := &Ngrok{AuthTokenFile: tokenFile}
+	provisionNgrok(t, first)
+	require.Equal(t, "first", first.AuthToken)
+
+	// the token is rotated, and the config reloaded
+	require.Nil(t, os.WriteFile(tokenFile, []byte("second"), 0o600))
+
+	second := &Ngrok{AuthTokenFile: tokenFile}
+	provisionNgrok(t, second)
+	require.Equal(t, "second", second.AuthToken)
+
+	require.NotEqual(t, first.shared.session().key, second.shared.session().key)
+}
@@ -0,0 +1,283 @@
+package ngroklistener
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// minLenPassword is the minimum length of the basic_auth passwords
+	minLenPassword = 8
+	// minLenHashedPassword is the minimum length of the plaintext of a hashed
+	// basic_auth password
+	minLenHashedPassword = 12
+)
+
+type basicAuthCred struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// PasswordHash is the bcrypt or argon2id hash of the password, as
+	// produced by `caddy hash-password`. The plaintext password, which ngrok
+	// needs to authenticate the requests, is read from `password_env` or
+	// `password_file` when the config is loaded, and checked against it.
+	PasswordHash string `json:"password_hash,omitempty"`
+
+	// PasswordEnv is the environment variable holding the plaintext of the
+	// hashed password.
+	PasswordEnv string `json:"password_env,omitempty"`
+
+	// PasswordFile is the path of the file holding the plaintext of the
+	// hashed password, e.g. a mounted Docker or Kubernetes secret.
+	PasswordFile string `json:"password_file,omitempty"`
+}
+
+// provision loads the plaintext of a hashed password, making sure it matches
+// its hash and complies with the password policy.
+func (c *basicAuthCred) provision() error {
+	password, err := resolveSecret(c.Password)
+	if err != nil {
+		return fmt.Errorf("resolving password: %v", err)
+	}
+	c.Password = password
+
+	if c.PasswordHash == "" {
+		if c.PasswordEnv != "" || c.PasswordFile != "" {
+			return errors.New("password_env and password_file require a password_hash")
+		}
+
+		return nil
+	}
+
+	if c.Password != "" {
+		return errors.New("password and password_hash are mutually exclusive")
+	}
+
+	switch {
+	case c.PasswordEnv != "" && c.PasswordFile != "":
+		return errors.New("only one of password_env and password_file may be set")
+	case c.PasswordEnv != "":
+		c.Password = os.Getenv(c.PasswordEnv)
+	case c.PasswordFile != "":
+		raw, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("reading password_file: %v", err)
+		}
+		c.Password = strings.TrimRight(string(raw), "\r\n")
+	default:
+		return errors.New("a hashed password requires password_env or password_file")
+	}
+
+	if err := checkPasswordPolicy(c.Username, c.Password); err != nil {
+		return err
+	}
+
+	return comparePasswordHash(c.PasswordHash, c.Password)
+}
+
+// checkPasswordPolicy rejects the passwords shorter than 12 characters, made
+// of less than 3 of the lower case, upper case, digit and symbol character
+// classes, or containing the username.
+func checkPasswordPolicy(username, password string) error {
+	if len(password) < minLenHashedPassword {
+		return fmt.Errorf("password must be at least %d characters", minLenHashedPassword)
+	}
+
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < 3 {
+		return errors.New("password must mix at least 3 of lower case letters, upper case letters, digits and symbols")
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("password must not contain the username")
+	}
+
+	return nil
+}
+
+// comparePasswordHash checks the password against its bcrypt or argon2id hash,
+// which may be base64-encoded like `caddy hash-password` outputs it
+func comparePasswordHash(hash, password string) error {
+	if !strings.HasPrefix(hash, "$") {
+		if decoded, err := base64.StdEncoding.DecodeString(hash); err == nil {
+			hash = string(decoded)
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return fmt.Errorf("password does not match its hash: %v", err)
+		}
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return compareArgon2idHash(hash, password)
+	default:
+		return errors.New("unsupported password_hash; expected a bcrypt or argon2id hash")
+	}
+
+	return nil
+}
+
+// compareArgon2idHash checks the password against an argon2id hash encoded
+// as $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+func compareArgon2idHash(hash, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return errors.New("malformed argon2id password_hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return fmt.Errorf("malformed argon2id password_hash version: %v", err)
+	}
+	if version != argon2.Version {
+		return fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	var (
+		memory  uint32
+		time    uint32
+		threads uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return fmt.Errorf("malformed argon2id password_hash parameters: %v", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("malformed argon2id password_hash salt: %v", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return fmt.Errorf("malformed argon2id password_hash key: %v", err)
+	}
+
+	actual := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return errors.New("password does not match its hash")
+	}
+
+	return nil
+}
+
+// readBasicAuthFile reads the credentials of an htpasswd-style file of
+// `user:password` lines, skipping the blank and `#` comment lines. The
+// passwords are in plaintext, since ngrok needs them to check the requests.
+func readBasicAuthFile(path string) ([]basicAuthCred, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var creds []basicAuthCred
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		username, password, ok := strings.Cut(entry, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("line %d: expected user:password", line)
+		}
+
+		if format, hashed := htpasswdHash(password); hashed {
+			return nil, fmt.Errorf("line %d: %s hashed passwords are not supported, ngrok needs the plaintext password", line, format)
+		}
+
+		if len(password) < minLenPassword {
+			return nil, fmt.Errorf("line %d: password must be at least eight characters", line)
+		}
+
+		creds = append(creds, basicAuthCred{Username: username, Password: password})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(creds) == 0 {
+		return nil, errors.New("no credentials found")
+	}
+
+	return creds, nil
+}
+
+// htpasswdHash reports whether the password of an htpasswd entry is hashed,
+// and with which format: any of the `$`-prefixed crypt formats, e.g. bcrypt or
+// Apache MD5, `{SHA}`, or the 13 characters of the classic DES crypt. A
+// plaintext password looking like a DES crypt hash is rejected as well.
+func htpasswdHash(password string) (string, bool) {
+	switch {
+	case strings.HasPrefix(password, "$"):
+		return "crypt", true
+	case strings.HasPrefix(password, "{SHA}"):
+		return "SHA-1", true
+	case len(password) == 13 && strings.Trim(password, "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz") == "":
+		return "DES crypt", true
+	default:
+		return "", false
+	}
+}
+
+// unmarshalHashedBasicAuth parses the block of a user whose password is hashed
+func (t *HTTP) unmarshalHashedBasicAuth(d *caddyfile.Dispenser, username string) error {
+	cred := basicAuthCred{Username: username}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "password_hash":
+			if !d.AllArgs(&cred.PasswordHash) {
+				return d.ArgErr()
+			}
+		case "password_env":
+			if !d.AllArgs(&cred.PasswordEnv) {
+				return d.ArgErr()
+			}
+		case "password_file":
+			if !d.AllArgs(&cred.PasswordFile) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized basic_auth subdirective %s", subdirective)
+		}
+	}
+
+	if cred.PasswordHash == "" {
+		return d.Err("a hashed basic_auth requires a password_hash")
+	}
+
+	if (cred.PasswordEnv == "") == (cred.PasswordFile == "") {
+		return d.Err("a hashed basic_auth requires one of password_env and password_file")
+	}
+
+	t.BasicAuth = append(t.BasicAuth, cred)
+
+	return nil
+}
@@ -0,0 +1,391 @@
+package ngroklistener
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const hashedPassword = "Correct-Horse-9"
+
+func bcryptHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.Nil(t, err)
+
+	return string(hash)
+}
+
+func argon2idHash(password string) string {
+	salt := []byte("saltsaltsaltsalt")
+	key := argon2.IDKey([]byte(password), salt, 1, 64*1024, 1, 32)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, 64*1024, 1, 1,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func TestHTTPBasicAuthHashed(t *testing.T) {
+	bcryptHashed := bcryptHash(t, hashedPassword)
+	argon2idHashed := argon2idHash(hashedPassword)
+
+	t.Setenv("NGROK_BASIC_AUTH_PASSWORD", hashedPassword)
+	t.Setenv("NGROK_BASIC_AUTH_WEAK", "password1234")
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.Nil(t, os.WriteFile(passwordFile, []byte(hashedPassword+"\n"), 0o600))
+
+	cases := genericTestCases[*HTTP]{
+		{
+			name: "bcrypt-env",
+			caddyInput: `http {
+				basic_auth foo {
+					password_hash ` + bcryptHashed + `
+					password_env NGROK_BASIC_AUTH_PASSWORD
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				expected := []basicAuthCred{
+					{Username: "foo", PasswordHash: bcryptHashed, PasswordEnv: "NGROK_BASIC_AUTH_PASSWORD"},
+				}
+
+				require.Equal(t, expected, actual.BasicAuth)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithBasicAuth("foo", hashedPassword),
+			),
+		},
+		{
+			name: "argon2id-file",
+			caddyInput: `http {
+				basic_auth foo {
+					password_hash ` + argon2idHashed + `
+					password_file ` + passwordFile + `
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				expected := []basicAuthCred{
+					{Username: "foo", PasswordHash: argon2idHashed, PasswordFile: passwordFile},
+				}
+
+				require.Equal(t, expected, actual.BasicAuth)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithBasicAuth("foo", hashedPassword),
+			),
+		},
+		{
+			name: "base64-bcrypt",
+			caddyInput: `http {
+				basic_auth foo {
+					password_hash ` + base64.StdEncoding.EncodeToString([]byte(bcryptHashed)) + `
+					password_env NGROK_BASIC_AUTH_PASSWORD
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithBasicAuth("foo", hashedPassword),
+			),
+		},
+		{
+			name: "block",
+			caddyInput: `http {
+				basic_auth {
+					spam eggsandcheese
+					foo {
+						password_hash ` + bcryptHashed + `
+						password_env NGROK_BASIC_AUTH_PASSWORD
+					}
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				expected := []basicAuthCred{
+					{Username: "spam", Password: "eggsandcheese"},
+					{Username: "foo", PasswordHash: bcryptHashed, PasswordEnv: "NGROK_BASIC_AUTH_PASSWORD"},
+				}
+
+				require.Equal(t, expected, actual.BasicAuth)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithBasicAuth("spam", "eggsandcheese"),
+				config.WithBasicAuth("foo", hashedPassword),
+			),
+		},
+		{
+			name: "along-plaintext",
+			caddyInput: `http {
+				basic_auth spam eggsandcheese
+				basic_auth foo {
+					password_hash ` + bcryptHashed + `
+					password_env NGROK_BASIC_AUTH_PASSWORD
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Len(t, actual.BasicAuth, 2)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithBasicAuth("spam", "eggsandcheese"),
+				config.WithBasicAuth("foo", hashedPassword),
+			),
+		},
+		{
+			name: "hash-mismatch",
+			caddyInput: `http {
+				basic_auth foo {
+					password_hash ` + bcryptHash(t, "Another-Horse-9") + `
+					password_env NGROK_BASIC_AUTH_PASSWORD
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "weak-password",
+			caddyInput: `http {
+				basic_auth foo {
+					password_hash ` + bcryptHash(t, "password1234") + `
+					password_env NGROK_BASIC_AUTH_WEAK
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "unset-env",
+			caddyInput: `http {
+				basic_auth foo {
+					password_hash ` + bcryptHashed + `
+					password_env NGROK_BASIC_AUTH_UNSET
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "unsupported-hash",
+			caddyInput: `http {
+				basic_auth foo {
+					password_hash $1$foo$bar
+					password_env NGROK_BASIC_AUTH_PASSWORD
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "no-hash",
+			caddyInput: `http {
+				basic_auth foo {
+					password_env NGROK_BASIC_AUTH_PASSWORD
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "no-plaintext-source",
+			caddyInput: `http {
+				basic_auth foo {
+					password_hash ` + bcryptHashed + `
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "both-plaintext-sources",
+			caddyInput: `http {
+				basic_auth foo {
+					password_hash ` + bcryptHashed + `
+					password_env NGROK_BASIC_AUTH_PASSWORD
+					password_file ` + passwordFile + `
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "block-no-hash",
+			caddyInput: `http {
+				basic_auth {
+					foo {
+						password_env NGROK_BASIC_AUTH_PASSWORD
+					}
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "unrecognized-subdirective",
+			caddyInput: `http {
+				basic_auth foo {
+					password barbarbar
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+
+	cases.runAll(t)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	require.Nil(t, checkPasswordPolicy("foo", hashedPassword))
+	require.NotNil(t, checkPasswordPolicy("foo", "Short-1"))
+	require.NotNil(t, checkPasswordPolicy("foo", "alllowercaseletters"))
+	require.NotNil(t, checkPasswordPolicy("horse", hashedPassword))
+}
+
+func TestHTTPBasicAuthFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	htpasswd := write("htpasswd", "# team\nfoo:barbarbar\n\nspam:eggs:and:cheese\n")
+	hashed := write("hashed", "foo:"+bcryptHash(t, hashedPassword)+"\n")
+	short := write("short", "foo:bar\n")
+	malformed := write("malformed", "foo\n")
+	empty := write("empty", "# nobody\n")
+
+	cases := genericTestCases[*HTTP]{
+		{
+			name: "file",
+			caddyInput: `http {
+				basic_auth_file ` + htpasswd + `
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Equal(t, htpasswd, actual.BasicAuthFile)
+				require.Empty(t, actual.BasicAuth)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithBasicAuth("foo", "barbarbar"),
+				config.WithBasicAuth("spam", "eggs:and:cheese"),
+			),
+		},
+		{
+			name: "along-inline",
+			caddyInput: `http {
+				basic_auth bam bambinos
+				basic_auth_file ` + htpasswd + `
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithBasicAuth("bam", "bambinos"),
+				config.WithBasicAuth("foo", "barbarbar"),
+				config.WithBasicAuth("spam", "eggs:and:cheese"),
+			),
+		},
+		{
+			name: "no-arg",
+			caddyInput: `http {
+				basic_auth_file
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "too-many-arg",
+			caddyInput: `http {
+				basic_auth_file foo bar
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "missing",
+			caddyInput: `http {
+				basic_auth_file ` + filepath.Join(dir, "missing") + `
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "hashed",
+			caddyInput: `http {
+				basic_auth_file ` + hashed + `
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "password-too-short",
+			caddyInput: `http {
+				basic_auth_file ` + short + `
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "malformed",
+			caddyInput: `http {
+				basic_auth_file ` + malformed + `
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "empty",
+			caddyInput: `http {
+				basic_auth_file ` + empty + `
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+	}
+
+	cases.runAll(t)
+}
+
+func TestReadBasicAuthFileHashed(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, tc := range map[string]struct {
+		entry string
+		err   string
+	}{
+		"bcrypt":    {"foo:" + bcryptHash(t, hashedPassword), "line 2: crypt hashed passwords are not supported, ngrok needs the plaintext password"},
+		"apr1":      {"foo:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "line 2: crypt hashed passwords are not supported, ngrok needs the plaintext password"},
+		"sha":       {"foo:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "line 2: SHA-1 hashed passwords are not supported, ngrok needs the plaintext password"},
+		"des crypt": {"foo:rqXexS6ZhobKA", "line 2: DES crypt hashed passwords are not supported, ngrok needs the plaintext password"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			require.Nil(t, os.WriteFile(path, []byte("spam:eggs-and-cheese\n"+tc.entry+"\n"), 0o600))
+
+			_, err := readBasicAuthFile(path)
+			require.EqualError(t, err, tc.err)
+		})
+	}
+
+	// plaintext passwords of another length or with other characters are kept
+	path := filepath.Join(dir, "plaintext")
+	require.Nil(t, os.WriteFile(path, []byte("foo:rqXexS6Zhob-A\nbar:rqXexS6Zhob!\n"), 0o600))
+
+	creds, err := readBasicAuthFile(path)
+	require.Nil(t, err)
+	require.Equal(t, []basicAuthCred{{Username: "foo", Password: "rqXexS6Zhob-A"}, {Username: "bar", Password: "rqXexS6Zhob!"}}, creds)
+}
+
+func TestBasicAuthFileReload(t *testing.T) {
+	withCountingSession(t)
+
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	require.Nil(t, os.WriteFile(htpasswd, []byte("foo:barbarbar\n"), 0o600))
+	tunnel := []byte(`{"type":"http","basic_auth_file":"` + htpasswd + `"}`)
+
+	first := &Ngrok{AuthToken: "basic-auth-file-test", TunnelRaw: tunnel}
+	provisionNgrok(t, first)
+
+	// the file is changed, and the config reloaded
+	require.Nil(t, os.WriteFile(htpasswd, []byte("foo:bazbazbaz\n"), 0o600))
+
+	second := &Ngrok{AuthToken: "basic-auth-file-test", TunnelRaw: tunnel}
+	provisionNgrok(t, second)
+	require.NotSame(t, first.shared, second.shared)
+	require.Equal(t, config.HTTPEndpoint(config.WithBasicAuth("foo", "bazbazbaz")), second.tunnel.NgrokTunnel())
+}
@@ -0,0 +1,60 @@
+package ngroklistener
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// visitorConn is a connection proxied by the ngrok agent, which reports the
+// address of the visitor the edge read it from as its remote address
+type visitorConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c visitorConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestClientIP(t *testing.T) {
+	sess := withCountingSession(t)
+
+	cfg := []byte(`{
+		"admin": {"disabled": true},
+		"apps": {
+			"http": {
+				"servers": {
+					"ngrok": {
+						"listen": ["127.0.0.1:0"],
+						"listener_wrappers": [{"wrapper": "ngrok", "auth_token": "client-ip-test", "tunnel": {"type": "http"}}],
+						"automatic_https": {"disable": true},
+						"routes": [{"handle": [{"handler": "static_response", "body": "{http.vars.client_ip}"}]}]
+					}
+				}
+			}
+		}
+	}`)
+	require.Nil(t, caddy.Load(cfg, true))
+	t.Cleanup(func() { require.Nil(t, caddy.Stop()) })
+
+	server, client := net.Pipe()
+	defer client.Close()
+	sess.last.Load().conns <- visitorConn{Conn: server, addr: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}}
+
+	// the header set by the visitor is not trusted
+	_, err := fmt.Fprint(client, "GET / HTTP/1.1\r\nHost: example.ngrok.app\r\nX-Forwarded-For: 10.0.0.1\r\nConnection: close\r\n\r\n")
+	require.Nil(t, err)
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "203.0.113.7", string(body))
+}
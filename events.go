@@ -0,0 +1,68 @@
+package ngroklistener
+
+import (
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+)
+
+// The events emitted through the Caddy events app
+const (
+	eventSessionConnected    = "ngrok.session_connected"
+	eventSessionDisconnected = "ngrok.session_disconnected"
+	eventTunnelStarted       = "ngrok.tunnel_started"
+	eventTunnelClosed        = "ngrok.tunnel_closed"
+	eventRemoteCommand       = "ngrok.remote_command"
+)
+
+// eventsApp is the part of caddyevents.App used to emit events
+type eventsApp interface {
+	Emit(ctx caddy.Context, eventName string, data map[string]any) caddyevents.Event
+}
+
+// eventEmitter emits events through the events app of the config an ngrok
+// listener wrapper was provisioned in
+type eventEmitter struct {
+	ctx caddy.Context
+	app eventsApp
+}
+
+func newEventEmitter(ctx caddy.Context) *eventEmitter {
+	e := &eventEmitter{ctx: ctx}
+
+	// the http app loads the events app before provisioning the listener
+	// wrappers, so there is no need to load it here
+	if app, ok := ctx.AppIfConfigured("events").(*caddyevents.App); ok {
+		e.app = app
+	}
+
+	return e
+}
+
+func (e *eventEmitter) emit(name string, data map[string]any) {
+	if e == nil || e.app == nil {
+		return
+	}
+
+	e.app.Emit(e.ctx, name, data)
+}
+
+// emitterRef points at the emitter of the latest config using a pooled
+// session or tunnel, as those outlive the config which created them
+type emitterRef struct {
+	atomic.Pointer[eventEmitter]
+}
+
+func (r *emitterRef) emit(name string, data map[string]any) {
+	r.Load().emit(name, data)
+}
+
+// errString returns the message of err, or an empty string if err is nil
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,103 @@
+package ngroklistener
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type recordedEvent struct {
+	name string
+	data map[string]any
+}
+
+// eventsRecorder records the emitted events
+type eventsRecorder struct {
+	mu     sync.Mutex
+	events []recordedEvent
+}
+
+func (r *eventsRecorder) Emit(_ caddy.Context, name string, data map[string]any) caddyevents.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, recordedEvent{name, data})
+	return caddyevents.Event{Data: data}
+}
+
+func (r *eventsRecorder) recorded() []recordedEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]recordedEvent(nil), r.events...)
+}
+
+func TestEmitWithoutEventsApp(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	e := newEventEmitter(ctx)
+	require.Nil(t, e.app)
+	e.emit(eventTunnelStarted, nil)
+
+	var ref emitterRef
+	ref.emit(eventTunnelStarted, nil)
+}
+
+func TestSessionEvents(t *testing.T) {
+	rec := &eventsRecorder{}
+
+	s := &session{ctx: context.Background(), region: "eu", server: "tunnel.example.com:443", l: zap.NewNop()}
+	s.events.Store(&eventEmitter{app: rec})
+
+	s.onConnect(context.Background(), nil)
+	s.onDisconnect(context.Background(), nil, errors.New("connection reset"))
+
+	require.Equal(t, []recordedEvent{
+		{
+			name: "ngrok.session_connected",
+			data: map[string]any{"region": "eu", "server": "tunnel.example.com:443"},
+		},
+		{
+			name: "ngrok.session_disconnected",
+			data: map[string]any{"region": "eu", "server": "tunnel.example.com:443", "error": "connection reset"},
+		},
+	}, rec.recorded())
+}
+
+func TestTunnelEvents(t *testing.T) {
+	withCountingSession(t)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	rec := &eventsRecorder{}
+
+	n := &Ngrok{AuthToken: "events-test", Region: "ap", tunnel: new(TCP)}
+	n.ctx = ctx
+	n.l = zap.NewNop()
+	n.events = &eventEmitter{app: rec}
+	n.ConnectTimeout = caddy.Duration(defaultConnectTimeout)
+
+	tun, err := n.acquireTunnel()
+	require.Nil(t, err)
+	require.Nil(t, releaseTunnel(tun.key))
+
+	data := map[string]any{
+		"url":    "https://fake.ngrok.app",
+		"id":     "tn_fake",
+		"proto":  "https",
+		"region": "ap",
+		"error":  "",
+	}
+	require.Equal(t, []recordedEvent{
+		{name: "ngrok.tunnel_started", data: data},
+		{name: "ngrok.tunnel_closed", data: data},
+	}, rec.recorded())
+}
@@ -0,0 +1,170 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(new(Health))
+	httpcaddyfile.RegisterHandlerDirective("ngrok_health", parseHealth)
+}
+
+// The settings ngrok-go uses when they are not configured
+const (
+	defaultServer             = "tunnel.ngrok.com:443"
+	defaultHeartbeatInterval  = 10 * time.Second
+	defaultHeartbeatTolerance = 15 * time.Second
+)
+
+// pendingTunnels counts the tunnels being retried in the background
+var pendingTunnels atomic.Int64
+
+// Health is an HTTP handler responding with the health of the ngrok sessions
+// and tunnels, e.g. for readiness probes. It responds with 200 while every
+// ngrok tunnel is up and not closed, and every session is connected and heard from ngrok
+// within its heartbeat interval and tolerance; it responds with 503 otherwise,
+// including when no ngrok tunnel is open.
+//
+// The response body is a JSON document describing the health of each
+// session. The handler does not call the next handlers.
+type Health struct{}
+
+// healthStatus is the response of the Health handler
+type healthStatus struct {
+	Healthy  bool                  `json:"healthy"`
+	Error    string                `json:"error,omitempty"`
+	Sessions []sessionHealthStatus `json:"sessions"`
+}
+
+type sessionHealthStatus struct {
+	ID               string    `json:"id"`
+	Connected        bool      `json:"connected"`
+	HeartbeatLatency string    `json:"heartbeat_latency,omitempty"`
+	LastHeartbeat    time.Time `json:"last_heartbeat"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// CaddyModule implements caddy.Module
+func (*Health) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.ngrok_health",
+		New: func() caddy.Module {
+			return new(Health)
+		},
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler
+func (*Health) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	status := checkHealth(time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if status.Healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	return json.NewEncoder(w).Encode(status)
+}
+
+// checkHealth reports the health of the pooled sessions and tunnels
+func checkHealth(now time.Time) healthStatus {
+	status := healthStatus{Healthy: true, Sessions: []sessionHealthStatus{}}
+
+	switch {
+	case pendingTunnels.Load() > 0:
+		status.Healthy = false
+		status.Error = "ngrok tunnel not established yet"
+	case len(pooledTunnels()) == 0:
+		status.Healthy = false
+		status.Error = "no ngrok tunnel open"
+	default:
+		// the tunnels closed through the admin API or by ngrok stay pooled
+		// until the configs using them are unloaded
+		for _, tun := range pooledTunnels() {
+			if tun.closed() {
+				status.Healthy = false
+				status.Error = fmt.Sprintf("ngrok tunnel %s closed", tun.ID())
+				break
+			}
+		}
+	}
+
+	for _, sess := range pooledSessions() {
+		sessStatus := sessionHealthStatus{
+			ID:            sess.id,
+			Connected:     sess.connected.Load(),
+			LastHeartbeat: time.Unix(0, sess.lastHeartbeat.Load()),
+		}
+
+		if latency := sess.heartbeatLatency.Load(); latency > 0 {
+			sessStatus.HeartbeatLatency = time.Duration(latency).String()
+		}
+
+		if err := sess.healthy(now); err != nil {
+			status.Healthy = false
+			sessStatus.Error = err.Error()
+		}
+
+		status.Sessions = append(status.Sessions, sessStatus)
+	}
+
+	return status
+}
+
+// healthy reports why the session is unhealthy: disconnected, or not heard
+// from ngrok for longer than its heartbeat interval and tolerance.
+func (s *session) healthy(now time.Time) error {
+	if !s.connected.Load() {
+		return fmt.Errorf("session disconnected")
+	}
+
+	if missed := s.missedHeartbeat(now); missed > 0 {
+		return fmt.Errorf("no heartbeat for %s", missed.Round(time.Millisecond))
+	}
+
+	return nil
+}
+
+func (*Health) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			return d.Errf("unrecognized subdirective %s", d.Val())
+		}
+	}
+
+	return nil
+}
+
+func parseHealth(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	hc := new(Health)
+	err := hc.UnmarshalCaddyfile(h.Dispenser)
+
+	return hc, err
+}
+
+var (
+	_ caddy.Module                = (*Health)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Health)(nil)
+	_ caddyfile.Unmarshaler       = (*Health)(nil)
+)
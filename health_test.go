@@ -0,0 +1,132 @@
+package ngroklistener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
+)
+
+func serveHealth(t *testing.T) (int, healthStatus) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	require.Nil(t, new(Health).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil), nil))
+
+	var status healthStatus
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &status))
+
+	return rec.Code, status
+}
+
+func TestHealth(t *testing.T) {
+	withCountingSession(t)
+
+	code, status := serveHealth(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "no ngrok tunnel open", status.Error)
+
+	n := &Ngrok{AuthToken: "health-test"}
+	provisionNgrok(t, n)
+	sess := n.shared.session()
+
+	code, status = serveHealth(t)
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, status.Healthy)
+	require.Len(t, status.Sessions, 1)
+	require.Equal(t, sess.id, status.Sessions[0].ID)
+	require.True(t, status.Sessions[0].Connected)
+
+	sess.onHeartbeat(context.Background(), nil, 42*time.Millisecond)
+	_, status = serveHealth(t)
+	require.Equal(t, "42ms", status.Sessions[0].HeartbeatLatency)
+
+	// no heartbeat within the default interval and tolerance
+	sess.lastHeartbeat.Store(time.Now().Add(-30 * time.Second).UnixNano())
+	code, status = serveHealth(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, status.Sessions[0].Error, "no heartbeat")
+
+	sess.onConnect(context.Background(), nil)
+	code, _ = serveHealth(t)
+	require.Equal(t, http.StatusOK, code)
+
+	sess.onDisconnect(context.Background(), nil, errors.New("connection reset"))
+	code, status = serveHealth(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "session disconnected", status.Sessions[0].Error)
+
+	sess.onConnect(context.Background(), nil)
+	_, err := n.shared.close()
+	require.Nil(t, err)
+	code, status = serveHealth(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "ngrok tunnel "+n.shared.ID()+" closed", status.Error)
+}
+
+func TestHealthPendingTunnel(t *testing.T) {
+	defer func(orig func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error)) {
+		connect = orig
+	}(connect)
+
+	connect = func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		return nil, errors.New("authentication failed")
+	}
+
+	n := &Ngrok{AuthToken: "health-pending-test", OnFailure: "retry"}
+	unload := provisionNgrok(t, n)
+
+	code, status := serveHealth(t)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "ngrok tunnel not established yet", status.Error)
+
+	unload()
+	require.Zero(t, pendingTunnels.Load())
+}
+
+func TestSessionHealthyTolerance(t *testing.T) {
+	s := &session{heartbeatInterval: time.Second, heartbeatTolerance: 2 * time.Second}
+	s.connected.Store(true)
+
+	now := time.Now()
+	s.lastHeartbeat.Store(now.Add(-2 * time.Second).UnixNano())
+	require.Nil(t, s.healthy(now))
+
+	s.lastHeartbeat.Store(now.Add(-4 * time.Second).UnixNano())
+	require.NotNil(t, s.healthy(now))
+}
+
+func TestParseHealth(t *testing.T) {
+	require.Nil(t, new(Health).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`ngrok_health`)))
+	require.NotNil(t, new(Health).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`ngrok_health arg1`)))
+	require.NotNil(t, new(Health).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`ngrok_health {
+		foo
+	}`)))
+
+	adapted, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(`:8080 {
+		route /ready {
+			ngrok_health
+		}
+	}`), nil)
+	require.Nil(t, err)
+	require.Contains(t, string(adapted), `"handler":"ngrok_health"`)
+
+	_, _, err = caddyconfig.GetAdapter("caddyfile").Adapt([]byte(`{
+		order ngrok_health before respond
+	}
+
+	:8080 {
+		handle /ready {
+			ngrok_health
+		}
+	}`), nil)
+	require.Nil(t, err)
+}
@@ -45,22 +45,28 @@ type HTTP struct {
 	// A map of basicauth, username and password value pairs for this tunnel.
 	BasicAuth []basicAuthCred `json:"basic_auth,omitempty"`
 
+	// The path of an htpasswd-style file of `user:password` lines, holding
+	// more basicauth credentials for this tunnel. The file is read again on
+	// every config load.
+	BasicAuthFile string `json:"basic_auth_file,omitempty"`
+
+	basicAuthFileCreds []basicAuthCred
+
 	OIDC *oidc `json:"oidc,omitempty"`
 
 	OAuth *oauth `json:"oauth,omitempty"`
 
 	WebhookVerification *webhookVerification `json:"webhook_verification,omitempty"`
 
+	// Requires the clients to present a certificate signed by one of the CAs.
+	MutualTLS *mutualTLS `json:"mutual_tls,omitempty"`
+
 	RequestHeader *httpRequestHeaders `json:"request_header,omitempty"`
 
 	ResponseHeader *httpResponseHeaders `json:"header,omitempty"`
 
-	l *zap.Logger
-}
-
-type basicAuthCred struct {
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
+	inline []string
+	l      *zap.Logger
 }
 
 // CaddyModule implements caddy.Module
@@ -77,6 +83,8 @@ func (*HTTP) CaddyModule() caddy.ModuleInfo {
 func (t *HTTP) Provision(ctx caddy.Context) error {
 	t.l = ctx.Logger()
 
+	t.inline = t.findInlineSecrets()
+
 	t.doReplace()
 
 	if err := t.provisionOpts(ctx); err != nil {
@@ -126,10 +134,27 @@ func (t *HTTP) provisionOpts(ctx caddy.Context) error {
 		t.opts = append(t.opts, config.WithWebsocketTCPConversion())
 	}
 
-	for _, basic_auth := range t.BasicAuth {
+	for i := range t.BasicAuth {
+		basic_auth := &t.BasicAuth[i]
+		if err := basic_auth.provision(); err != nil {
+			return fmt.Errorf("provisioning basic_auth for %s: %v", basic_auth.Username, err)
+		}
+
 		t.opts = append(t.opts, config.WithBasicAuth(basic_auth.Username, basic_auth.Password))
 	}
 
+	if t.BasicAuthFile != "" {
+		creds, err := readBasicAuthFile(t.BasicAuthFile)
+		if err != nil {
+			return fmt.Errorf("loading basic_auth_file: %v", err)
+		}
+
+		for _, basic_auth := range creds {
+			t.opts = append(t.opts, config.WithBasicAuth(basic_auth.Username, basic_auth.Password))
+		}
+		t.basicAuthFileCreds = creds
+	}
+
 	if t.OIDC != nil {
 		err := t.OIDC.Provision(ctx)
 		if err != nil {
@@ -154,6 +179,14 @@ func (t *HTTP) provisionOpts(ctx caddy.Context) error {
 		t.opts = append(t.opts, t.WebhookVerification.opt)
 	}
 
+	if t.MutualTLS != nil {
+		err := t.MutualTLS.Provision(ctx)
+		if err != nil {
+			return fmt.Errorf("provisioning mutual_tls: %v", err)
+		}
+		t.opts = append(t.opts, config.WithMutualTLSCA(t.MutualTLS.certs...))
+	}
+
 	if t.RequestHeader != nil {
 		err := t.RequestHeader.Provision(ctx)
 		if err != nil {
@@ -179,6 +212,7 @@ func (t *HTTP) doReplace() {
 		&t.Metadata,
 		&t.Domain,
 		&t.Scheme,
+		&t.BasicAuthFile,
 	}
 
 	for _, field := range replaceableFields {
@@ -200,13 +234,53 @@ func (t *HTTP) doReplace() {
 	}
 
 	for i, basic_auth := range t.BasicAuth {
-		actualUsername := repl.ReplaceKnown(basic_auth.Username, "")
+		t.BasicAuth[i].Username = repl.ReplaceKnown(basic_auth.Username, "")
+
+		t.BasicAuth[i].PasswordEnv = repl.ReplaceKnown(basic_auth.PasswordEnv, "")
+
+		t.BasicAuth[i].PasswordFile = repl.ReplaceKnown(basic_auth.PasswordFile, "")
+	}
+}
 
-		actualPassword := repl.ReplaceKnown(basic_auth.Password, "")
+// findInlineSecrets names the secrets written in the config as is, before
+// their placeholders are replaced
+func (t *HTTP) findInlineSecrets() []string {
+	var inline []string
+	for _, cred := range t.BasicAuth {
+		if inlineSecret(cred.Password) {
+			inline = append(inline, "basic_auth password of "+cred.Username)
+		}
+	}
 
-		t.BasicAuth[i] = basicAuthCred{Username: actualUsername, Password: actualPassword}
+	if t.OIDC != nil && inlineSecret(t.OIDC.ClientSecret) {
+		inline = append(inline, "oidc client_secret")
+	}
 
+	if t.WebhookVerification != nil && inlineSecret(t.WebhookVerification.Secret) {
+		inline = append(inline, "webhook_verification secret")
 	}
+
+	return inline
+}
+
+// inlineSecrets implements secretsTunnel
+func (t *HTTP) inlineSecrets() []string {
+	return t.inline
+}
+
+// keyMaterial implements keyedTunnel, as the basic_auth_file credentials and
+// the mutual_tls CA certificates are not part of the definition of the tunnel
+func (t *HTTP) keyMaterial() []string {
+	var material []string
+	for _, cred := range t.basicAuthFileCreds {
+		material = append(material, cred.Username, cred.Password)
+	}
+
+	if t.MutualTLS != nil {
+		material = append(material, t.MutualTLS.fingerprints()...)
+	}
+
+	return material
 }
 
 // convert to ngrok's Tunnel type
@@ -259,6 +333,10 @@ func (t *HTTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if err := t.unmarshalBasicAuth(d); err != nil {
 					return err
 				}
+			case "basic_auth_file":
+				if !d.AllArgs(&t.BasicAuthFile) {
+					return d.ArgErr()
+				}
 			case "oidc":
 				if err := t.unmarshalOIDC(d); err != nil {
 					return err
@@ -271,6 +349,10 @@ func (t *HTTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if err := t.unmarshalWebhookVerification(d); err != nil {
 					return err
 				}
+			case "mutual_tls":
+				if err := t.unmarshalMutualTLS(d); err != nil {
+					return err
+				}
 			case "request_header":
 				if err := t.unmarshalRequestHeader(d); err != nil {
 					return err
@@ -350,12 +432,14 @@ func (t *HTTP) unmarshalBasicAuth(d *caddyfile.Dispenser) error {
 		foundBasicAuth bool
 	)
 
-	minLenPassword := 8
-
 	if d.NextArg() { // basic_auth is defined inline
 
 		username = d.Val()
 
+		if d.CountRemainingArgs() == 0 { // the password of the user is hashed
+			return t.unmarshalHashedBasicAuth(d, username)
+		}
+
 		hasArgs = true
 		if !d.AllArgs(&password) {
 			return d.ArgErr()
@@ -377,12 +461,19 @@ func (t *HTTP) unmarshalBasicAuth(d *caddyfile.Dispenser) error {
 			return d.Err("cannot specify basic_auth in both arguments and block") // because it would be weird
 		}
 
+		foundBasicAuth = true
+
+		if d.CountRemainingArgs() == 0 { // the password of the user is hashed
+			if err := t.unmarshalHashedBasicAuth(d, username); err != nil {
+				return err
+			}
+			continue
+		}
+
 		if !d.AllArgs(&password) {
 			return d.ArgErr()
 		}
 
-		foundBasicAuth = true
-
 		if len(password) < minLenPassword {
 			return d.Err("password must be at least eight characters.")
 		}
@@ -449,6 +540,18 @@ func (t *HTTP) unmarshalWebhookVerification(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+func (t *HTTP) unmarshalMutualTLS(d *caddyfile.Dispenser) error {
+	mutualTLS := mutualTLS{}
+	err := mutualTLS.UnmarshalCaddyfile(d)
+	if err != nil {
+		return d.Errf(`parsing mutual_tls %w`, err)
+	}
+
+	t.MutualTLS = &mutualTLS
+
+	return nil
+}
+
 func (t *HTTP) unmarshalRequestHeader(d *caddyfile.Dispenser) error {
 	requestHeader := httpRequestHeaders{}
 	err := requestHeader.UnmarshalCaddyfile(d)
@@ -478,4 +581,6 @@ var (
 	_ Tunnel                = (*HTTP)(nil)
 	_ caddy.Provisioner     = (*HTTP)(nil)
 	_ caddyfile.Unmarshaler = (*HTTP)(nil)
+	_ keyedTunnel           = (*HTTP)(nil)
+	_ secretsTunnel         = (*HTTP)(nil)
 )
@@ -0,0 +1,190 @@
+package ngroklistener
+
+import (
+	"net"
+	"sync"
+)
+
+// pendingListener blocks in Accept until a listener is attached to it
+type pendingListener struct {
+	mu sync.Mutex
+	ln net.Listener
+
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPendingListener() *pendingListener {
+	return &pendingListener{
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// attach hands the listener to the pending Accept calls; the listener is
+// closed right away if the pending listener is already closed.
+func (l *pendingListener) attach(ln net.Listener) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		ln.Close()
+		return
+	default:
+	}
+
+	l.ln = ln
+	close(l.ready)
+}
+
+func (l *pendingListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.ready:
+		return l.ln.Accept()
+	}
+}
+
+func (l *pendingListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		close(l.done)
+		if l.ln != nil {
+			l.ln.Close()
+		}
+	})
+
+	return nil
+}
+
+func (l *pendingListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ln != nil {
+		return l.ln.Addr()
+	}
+
+	return pendingAddr{}
+}
+
+// multiListener accepts connections from all of its listeners. A listener
+// failing, e.g. as its tunnel is closed, is dropped while the others keep
+// being served; Accept fails once all of them failed.
+type multiListener struct {
+	listeners []net.Listener
+	addr      net.Addr
+
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// failed is closed once all of the listeners failed, with err the error
+	// of the last one
+	mu      sync.Mutex
+	serving int
+	failed  chan struct{}
+	err     error
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// newMultiListener returns a listener accepting connections from all of the
+// given listeners; its address is the one of the first listener.
+func newMultiListener(listeners ...net.Listener) *multiListener {
+	l := &multiListener{
+		listeners: listeners,
+		addr:      listeners[0].Addr(),
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+		serving:   len(listeners),
+		failed:    make(chan struct{}),
+	}
+
+	for _, ln := range listeners {
+		go l.acceptLoop(ln)
+	}
+
+	return l
+}
+
+func (l *multiListener) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				l.drop(err)
+				return
+			}
+		}
+
+		select {
+		case l.accepted <- acceptResult{conn, err}:
+		case <-l.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// drop stops serving a failed listener
+func (l *multiListener) drop(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.serving--
+	if l.serving == 0 {
+		l.err = err
+		close(l.failed)
+	}
+}
+
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	case res := <-l.accepted:
+		return res.conn, res.err
+	case <-l.failed:
+		return nil, l.err
+	}
+}
+
+func (l *multiListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		for _, ln := range l.listeners {
+			if cerr := ln.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+
+	return err
+}
+
+func (l *multiListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pendingAddr is the address of a listener whose tunnel is not up yet
+type pendingAddr struct{}
+
+func (pendingAddr) Network() string { return "ngrok" }
+func (pendingAddr) String() string  { return "pending" }
+
+var (
+	_ net.Listener = (*pendingListener)(nil)
+	_ net.Listener = (*multiListener)(nil)
+)
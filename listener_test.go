@@ -0,0 +1,70 @@
+package ngroklistener
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingListenerAttach(t *testing.T) {
+	pending := newPendingListener()
+	tun := newFakeTunnel()
+
+	pending.attach(tun)
+	require.Equal(t, tun.Addr(), pending.Addr())
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := pending.Accept()
+		accepted <- conn
+	}()
+
+	server, client := tun.dial()
+	defer client.Close()
+	require.Equal(t, server, <-accepted)
+
+	require.Nil(t, pending.Close())
+	require.True(t, tun.isClosed())
+}
+
+func TestMultiListener(t *testing.T) {
+	first, second := newFakeTunnel(), newFakeTunnel()
+	ln := newMultiListener(first, second)
+	require.Equal(t, first.Addr(), ln.Addr())
+
+	for _, tun := range []*fakeTunnel{first, second} {
+		go tun.dial()
+
+		conn, err := ln.Accept()
+		require.Nil(t, err)
+		require.NotNil(t, conn)
+	}
+
+	require.Nil(t, ln.Close())
+	require.True(t, first.isClosed())
+	require.True(t, second.isClosed())
+
+	_, err := ln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestMultiListenerFailure(t *testing.T) {
+	first, second := newFakeTunnel(), newFakeTunnel()
+	ln := newMultiListener(first, second)
+	defer ln.Close()
+
+	// the failing tunnel is dropped, the other one is still served
+	require.Nil(t, second.Close())
+
+	go first.dial()
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+	require.NotNil(t, conn)
+
+	// Accept fails once all of the listeners failed
+	require.Nil(t, first.Close())
+
+	_, err = ln.Accept()
+	require.NotNil(t, err)
+}
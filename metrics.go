@@ -0,0 +1,133 @@
+package ngroklistener
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// define and register the metrics used in this package.
+func init() {
+	const ns, sub = "caddy", "ngrok"
+
+	sessionLabels := []string{"session_id", "region"}
+	ngrokMetrics.sessionConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "session_connected",
+		Help:      "Whether the ngrok session is connected (1) or not (0).",
+	}, sessionLabels)
+	ngrokMetrics.sessionReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "session_reconnects_total",
+		Help:      "Number of times the ngrok session reconnected after its initial connection.",
+	}, sessionLabels)
+	ngrokMetrics.heartbeatLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "heartbeat_latency_seconds",
+		Help:      "Histogram of the ngrok session heartbeat latencies.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 10),
+	}, sessionLabels)
+
+	tunnelLabels := []string{"type", "url"}
+	ngrokMetrics.acceptedConns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "tunnel_accepted_connections_total",
+		Help:      "Number of connections accepted through the ngrok tunnel.",
+	}, tunnelLabels)
+	ngrokMetrics.activeConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "tunnel_active_connections",
+		Help:      "Number of open connections accepted through the ngrok tunnel.",
+	}, tunnelLabels)
+	ngrokMetrics.bytesIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "tunnel_received_bytes_total",
+		Help:      "Number of bytes received on the connections accepted through the ngrok tunnel.",
+	}, tunnelLabels)
+	ngrokMetrics.bytesOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "tunnel_sent_bytes_total",
+		Help:      "Number of bytes sent on the connections accepted through the ngrok tunnel.",
+	}, tunnelLabels)
+}
+
+// ngrokMetrics is the collection of metrics tracked for the ngrok sessions
+// and tunnels.
+var ngrokMetrics = struct {
+	sessionConnected  *prometheus.GaugeVec
+	sessionReconnects *prometheus.CounterVec
+	heartbeatLatency  *prometheus.HistogramVec
+
+	acceptedConns *prometheus.CounterVec
+	activeConns   *prometheus.GaugeVec
+	bytesIn       *prometheus.CounterVec
+	bytesOut      *prometheus.CounterVec
+}{}
+
+// connMetrics holds the metrics of a connection accepted through a tunnel,
+// resolved once per connection as the tunnel URL can change on restart.
+type connMetrics struct {
+	active   prometheus.Gauge
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+}
+
+// newConnMetrics counts a connection accepted through the tunnel t
+func newConnMetrics(t *sharedTunnel) connMetrics {
+	labels := prometheus.Labels{"type": t.kind, "url": t.URL()}
+
+	ngrokMetrics.acceptedConns.With(labels).Inc()
+
+	m := connMetrics{
+		active:   ngrokMetrics.activeConns.With(labels),
+		bytesIn:  ngrokMetrics.bytesIn.With(labels),
+		bytesOut: ngrokMetrics.bytesOut.With(labels),
+	}
+	m.active.Inc()
+
+	return m
+}
+
+// tunnelSeries counts the tunnels using the series of each tunnel type and
+// URL. The series are deleted once no tunnel uses them anymore, as the random
+// URLs of ngrok would otherwise leave a set of series behind on every
+// restart, reconnect or reload.
+var tunnelSeries = struct {
+	sync.Mutex
+	users map[[2]string]int
+}{users: make(map[[2]string]int)}
+
+// useTunnelSeries records that a tunnel uses the series of its type and URL
+func useTunnelSeries(kind, url string) {
+	tunnelSeries.Lock()
+	defer tunnelSeries.Unlock()
+
+	tunnelSeries.users[[2]string{kind, url}]++
+}
+
+// releaseTunnelSeries records that a tunnel no longer uses the series of its
+// type and URL, deleting them if no other tunnel uses them
+func releaseTunnelSeries(kind, url string) {
+	tunnelSeries.Lock()
+	defer tunnelSeries.Unlock()
+
+	key := [2]string{kind, url}
+	tunnelSeries.users[key]--
+	if tunnelSeries.users[key] > 0 {
+		return
+	}
+
+	delete(tunnelSeries.users, key)
+	ngrokMetrics.acceptedConns.DeleteLabelValues(kind, url)
+	ngrokMetrics.activeConns.DeleteLabelValues(kind, url)
+	ngrokMetrics.bytesIn.DeleteLabelValues(kind, url)
+	ngrokMetrics.bytesOut.DeleteLabelValues(kind, url)
+}
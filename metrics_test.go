@@ -0,0 +1,117 @@
+package ngroklistener
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionMetrics(t *testing.T) {
+	withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "session-metrics-test", Region: "eu"}
+	unload := provisionNgrok(t, n)
+	sess := n.shared.session()
+
+	sess.onConnect(context.Background(), nil)
+	require.Equal(t, 1.0, testutil.ToFloat64(ngrokMetrics.sessionConnected.WithLabelValues(sess.id, "eu")))
+	require.Equal(t, 0.0, testutil.ToFloat64(ngrokMetrics.sessionReconnects.WithLabelValues(sess.id, "eu")))
+
+	sess.onDisconnect(context.Background(), nil, io.EOF)
+	require.Equal(t, 0.0, testutil.ToFloat64(ngrokMetrics.sessionConnected.WithLabelValues(sess.id, "eu")))
+
+	sess.onConnect(context.Background(), nil)
+	require.Equal(t, 1.0, testutil.ToFloat64(ngrokMetrics.sessionConnected.WithLabelValues(sess.id, "eu")))
+	require.Equal(t, 1.0, testutil.ToFloat64(ngrokMetrics.sessionReconnects.WithLabelValues(sess.id, "eu")))
+
+	sess.onHeartbeat(context.Background(), nil, 20*time.Millisecond)
+	latency := &dto.Metric{}
+	require.Nil(t, ngrokMetrics.heartbeatLatency.WithLabelValues(sess.id, "eu").(prometheus.Metric).Write(latency))
+	require.EqualValues(t, 1, latency.GetHistogram().GetSampleCount())
+
+	unload()
+	require.False(t, ngrokMetrics.sessionConnected.DeleteLabelValues(sess.id, "eu"))
+}
+
+func TestTunnelMetrics(t *testing.T) {
+	sess := withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "tunnel-metrics-test", TunnelRaw: []byte(`{"type":"http"}`)}
+	provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+
+	accepted := ngrokMetrics.acceptedConns.WithLabelValues("http", "https://fake.ngrok.app")
+	active := ngrokMetrics.activeConns.WithLabelValues("http", "https://fake.ngrok.app")
+	bytesIn := ngrokMetrics.bytesIn.WithLabelValues("http", "https://fake.ngrok.app")
+	bytesOut := ngrokMetrics.bytesOut.WithLabelValues("http", "https://fake.ngrok.app")
+
+	acceptedBefore := testutil.ToFloat64(accepted)
+	activeBefore := testutil.ToFloat64(active)
+	inBefore := testutil.ToFloat64(bytesIn)
+	outBefore := testutil.ToFloat64(bytesOut)
+
+	acceptedConn := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		acceptedConn <- conn
+	}()
+	_, client := sess.last.Load().dial()
+	defer client.Close()
+	conn := <-acceptedConn
+
+	require.Equal(t, acceptedBefore+1, testutil.ToFloat64(accepted))
+	require.Equal(t, activeBefore+1, testutil.ToFloat64(active))
+
+	go client.Write([]byte("ping"))
+	_, err := io.ReadFull(conn, make([]byte, 4))
+	require.Nil(t, err)
+
+	go io.ReadFull(client, make([]byte, 5))
+	_, err = conn.Write([]byte("hello"))
+	require.Nil(t, err)
+
+	require.Equal(t, inBefore+4, testutil.ToFloat64(bytesIn))
+	require.Equal(t, outBefore+5, testutil.ToFloat64(bytesOut))
+
+	require.Nil(t, conn.Close())
+	require.Equal(t, activeBefore, testutil.ToFloat64(active))
+}
+
+func TestTunnelMetricsDeleted(t *testing.T) {
+	sess := withURLSession(t)
+
+	n := &Ngrok{AuthToken: "tunnel-metrics-deleted-test", TunnelRaw: []byte(`{"type":"http"}`)}
+	unload := provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+
+	accept := func() {
+		go sess.last.Load().dial()
+		conn, err := ln.Accept()
+		require.Nil(t, err)
+		require.Nil(t, conn.Close())
+	}
+
+	accept()
+	require.Equal(t, 1.0, testutil.ToFloat64(ngrokMetrics.acceptedConns.WithLabelValues("http", "https://1.ngrok.app")))
+
+	// the series of the previous URL are deleted once the tunnel is replaced
+	require.Nil(t, n.shared.restart(context.Background()))
+	accept()
+	require.False(t, ngrokMetrics.acceptedConns.DeleteLabelValues("http", "https://1.ngrok.app"))
+	require.Equal(t, 1.0, testutil.ToFloat64(ngrokMetrics.acceptedConns.WithLabelValues("http", "https://2.ngrok.app")))
+
+	// the series are deleted once the tunnel is released
+	unload()
+	for _, vec := range []interface {
+		DeleteLabelValues(...string) bool
+	}{ngrokMetrics.acceptedConns, ngrokMetrics.activeConns, ngrokMetrics.bytesIn, ngrokMetrics.bytesOut} {
+		require.False(t, vec.DeleteLabelValues("http", "https://2.ngrok.app"))
+	}
+}
@@ -0,0 +1,204 @@
+package ngroklistener
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/caddyserver/certmagic"
+)
+
+// tlsCertificates returns the certificates the Caddy `tls` app holds for the
+// SAN; swapped in tests
+var tlsCertificates = func(ctx caddy.Context, san string) ([]*x509.Certificate, error) {
+	if _, err := ctx.App("tls"); err != nil {
+		return nil, fmt.Errorf("loading tls app: %v", err)
+	}
+
+	var certs []*x509.Certificate
+	for _, cert := range caddytls.AllMatchingCertificates(san) {
+		leaf, err := certificateLeaf(cert)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, leaf)
+	}
+
+	return certs, nil
+}
+
+// certificateLeaf returns the parsed leaf of a certificate of the `tls` app
+func certificateLeaf(cert certmagic.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+
+	return x509.ParseCertificate(cert.Certificate.Certificate[0])
+}
+
+// mutualTLS makes the ngrok edge require the clients to present a certificate
+// signed by one of the CAs
+type mutualTLS struct {
+	certs []*x509.Certificate
+
+	// The paths of PEM files holding CA certificates
+	CAFiles []string `json:"ca_files,omitempty"`
+
+	// PEM encoded CA certificates
+	CAPEM []string `json:"ca_pem,omitempty"`
+
+	// The SANs of certificates loaded in the Caddy `tls` app, e.g. with
+	// `load_files`, to use as CA certificates
+	TLSCertificates []string `json:"tls_certificates,omitempty"`
+}
+
+func (m *mutualTLS) Provision(ctx caddy.Context) error {
+	m.doReplace()
+
+	m.certs = nil
+
+	for _, file := range m.CAFiles {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("reading CA file: %v", err)
+		}
+
+		certs, err := parseCAPEM(raw)
+		if err != nil {
+			return fmt.Errorf("parsing CA file %s: %v", file, err)
+		}
+		m.certs = append(m.certs, certs...)
+	}
+
+	for i, raw := range m.CAPEM {
+		certs, err := parseCAPEM([]byte(raw))
+		if err != nil {
+			return fmt.Errorf("parsing ca_pem %d: %v", i, err)
+		}
+		m.certs = append(m.certs, certs...)
+	}
+
+	for _, san := range m.TLSCertificates {
+		certs, err := tlsCertificates(ctx, san)
+		if err != nil {
+			return fmt.Errorf("loading tls certificates for %s: %v", san, err)
+		}
+		if len(certs) == 0 {
+			return fmt.Errorf("no tls certificate found for %s", san)
+		}
+		m.certs = append(m.certs, certs...)
+	}
+
+	if len(m.certs) == 0 {
+		return errors.New("mutual_tls requires at least one CA certificate")
+	}
+
+	now := time.Now()
+	for _, cert := range m.certs {
+		if now.After(cert.NotAfter) {
+			return fmt.Errorf("CA certificate %s expired on %s", cert.Subject, cert.NotAfter)
+		}
+		if now.Before(cert.NotBefore) {
+			return fmt.Errorf("CA certificate %s is not valid before %s", cert.Subject, cert.NotBefore)
+		}
+	}
+
+	return nil
+}
+
+// fingerprints returns the SHA-256 fingerprints of the CA certificates
+func (m *mutualTLS) fingerprints() []string {
+	var fingerprints []string
+	for _, cert := range m.certs {
+		sum := sha256.Sum256(cert.Raw)
+		fingerprints = append(fingerprints, hex.EncodeToString(sum[:]))
+	}
+
+	return fingerprints
+}
+
+// parseCAPEM parses the certificates of a PEM bundle
+func parseCAPEM(raw []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, raw = pem.Decode(raw)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block %s", block.Type)
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+
+	return certs, nil
+}
+
+func (m *mutualTLS) doReplace() {
+	repl := caddy.NewReplacer()
+
+	for index, file := range m.CAFiles {
+		actual := repl.ReplaceKnown(file, "")
+		m.CAFiles[index] = actual
+	}
+
+	for index, san := range m.TLSCertificates {
+		actual := repl.ReplaceKnown(san, "")
+		m.TLSCertificates[index] = actual
+	}
+}
+
+func (m *mutualTLS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "ca_file":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			m.CAFiles = append(m.CAFiles, d.RemainingArgs()...)
+		case "ca_pem":
+			var pem string
+			if !d.AllArgs(&pem) {
+				return d.ArgErr()
+			}
+			m.CAPEM = append(m.CAPEM, pem)
+		case "tls_certificate":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			m.TLSCertificates = append(m.TLSCertificates, d.RemainingArgs()...)
+		default:
+			return d.Errf("unrecognized subdirective %s", subdirective)
+		}
+	}
+
+	if len(m.CAFiles)+len(m.CAPEM)+len(m.TLSCertificates) == 0 {
+		return d.Err("mutual_tls requires at least one ca_file, ca_pem or tls_certificate")
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package ngroklistener
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok/config"
+)
+
+// withTLSCertificates makes the certificates of the Caddy tls app be looked
+// up in the given map
+func withTLSCertificates(t *testing.T, certs map[string][]*x509.Certificate) {
+	orig := tlsCertificates
+	t.Cleanup(func() { tlsCertificates = orig })
+
+	tlsCertificates = func(_ caddy.Context, san string) ([]*x509.Certificate, error) {
+		return certs[san], nil
+	}
+}
+
+func TestHTTPMutualTLS(t *testing.T) {
+	now := time.Now()
+	ca, caPEM, _ := newTestCert(t, testCert{name: "ca", ca: true})
+	other, otherPEM, _ := newTestCert(t, testCert{name: "other", ca: true})
+	_, expiredPEM, _ := newTestCert(t, testCert{name: "expired", ca: true, notBefore: now.Add(-2 * time.Hour), notAfter: now.Add(-time.Hour)})
+	_, notYetValidPEM, _ := newTestCert(t, testCert{name: "not-yet-valid", ca: true, notBefore: now.Add(time.Hour), notAfter: now.Add(2 * time.Hour)})
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+	caFile := write("ca.pem", caPEM)
+	bundleFile := write("bundle.pem", caPEM+otherPEM)
+	expiredFile := write("expired.pem", expiredPEM)
+	notYetValidFile := write("not-yet-valid.pem", notYetValidPEM)
+	garbageFile := write("garbage.pem", "not a certificate")
+
+	withTLSCertificates(t, map[string][]*x509.Certificate{"ca.internal": {other}})
+
+	cases := genericTestCases[*HTTP]{
+		{
+			name: "ca_file",
+			caddyInput: `http {
+				mutual_tls {
+					ca_file ` + caFile + `
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Equal(t, []string{caFile}, actual.MutualTLS.CAFiles)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithMutualTLSCA(ca),
+			),
+		},
+		{
+			name: "ca_file-bundle",
+			caddyInput: `http {
+				mutual_tls {
+					ca_file ` + bundleFile + `
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithMutualTLSCA(ca, other),
+			),
+		},
+		{
+			name:       "ca_pem",
+			caddyInput: "http {\n\tmutual_tls {\n\t\tca_pem `" + caPEM + "`\n\t}\n}",
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Equal(t, []string{caPEM}, actual.MutualTLS.CAPEM)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithMutualTLSCA(ca),
+			),
+		},
+		{
+			name: "tls_certificate",
+			caddyInput: `http {
+				mutual_tls {
+					tls_certificate ca.internal
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *HTTP) {
+				require.Equal(t, []string{"ca.internal"}, actual.MutualTLS.TLSCertificates)
+			},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithMutualTLSCA(other),
+			),
+		},
+		{
+			name:         "all-sources",
+			caddyInput:   "http {\n\tmutual_tls {\n\t\tca_file " + caFile + "\n\t\tca_pem `" + otherPEM + "`\n\t\ttls_certificate ca.internal\n\t}\n}",
+			expectConfig: func(t *testing.T, actual *HTTP) {},
+			expectedOpts: config.HTTPEndpoint(
+				config.WithMutualTLSCA(ca, other, other),
+			),
+		},
+		{
+			name: "empty",
+			caddyInput: `http {
+				mutual_tls {
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "arg",
+			caddyInput: `http {
+				mutual_tls foo {
+					ca_file ` + caFile + `
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "ca_file-no-arg",
+			caddyInput: `http {
+				mutual_tls {
+					ca_file
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "unrecognized-subdirective",
+			caddyInput: `http {
+				mutual_tls {
+					foo bar
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "ca_file-missing",
+			caddyInput: `http {
+				mutual_tls {
+					ca_file ` + filepath.Join(dir, "missing.pem") + `
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "ca_file-unparsable",
+			caddyInput: `http {
+				mutual_tls {
+					ca_file ` + garbageFile + `
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "ca_pem-unparsable",
+			caddyInput: `http {
+				mutual_tls {
+					ca_pem foo
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "expired",
+			caddyInput: `http {
+				mutual_tls {
+					ca_file ` + expiredFile + `
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "not-yet-valid",
+			caddyInput: `http {
+				mutual_tls {
+					ca_file ` + notYetValidFile + `
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "tls_certificate-unknown",
+			caddyInput: `http {
+				mutual_tls {
+					tls_certificate unknown.internal
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *HTTP) {},
+			expectProvisionErr: true,
+		},
+	}
+
+	cases.runAll(t)
+}
+
+func TestMutualTLSReload(t *testing.T) {
+	withCountingSession(t)
+
+	_, firstPEM, _ := newTestCert(t, testCert{name: "first", ca: true})
+	second, secondPEM, _ := newTestCert(t, testCert{name: "second", ca: true})
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(caFile, []byte(firstPEM), 0o600))
+	tunnel := []byte(`{"type":"http","mutual_tls":{"ca_files":["` + caFile + `"]}}`)
+
+	first := &Ngrok{AuthToken: "mutual-tls-test", TunnelRaw: tunnel}
+	provisionNgrok(t, first)
+
+	// the CA is rotated, and the config reloaded
+	require.Nil(t, os.WriteFile(caFile, []byte(secondPEM), 0o600))
+
+	rotated := &Ngrok{AuthToken: "mutual-tls-test", TunnelRaw: tunnel}
+	provisionNgrok(t, rotated)
+	require.NotSame(t, first.shared, rotated.shared)
+	require.Equal(t, config.HTTPEndpoint(config.WithMutualTLSCA(second)), rotated.tunnel.NgrokTunnel())
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
@@ -25,13 +27,61 @@ type Tunnel interface {
 	NgrokTunnel() config.Tunnel
 }
 
+const (
+	// onFailureFail aborts loading the config when the tunnel cannot be established
+	onFailureFail = "fail"
+	// onFailureFallbackLocal serves the listener passed by Caddy when the tunnel cannot be established
+	onFailureFallbackLocal = "fallback_local"
+	// onFailureRetry keeps retrying to establish the tunnel in the background
+	onFailureRetry = "retry"
+	// onFailureFallbackRetry serves the listener passed by Caddy while retrying
+	// to establish the tunnel in the background
+	onFailureFallbackRetry = "fallback_retry"
+)
+
+const (
+	// modeReplace serves the ngrok tunnel instead of the listener passed by Caddy
+	modeReplace = "replace"
+	// modeBoth serves both the ngrok tunnel and the listener passed by Caddy
+	modeBoth = "both"
+)
+
+const (
+	// remoteStopClose closes the tunnels of the session on a remote stop command
+	remoteStopClose = "close"
+	// remoteStopShutdown gracefully shuts Caddy down on a remote stop command
+	remoteStopShutdown = "shutdown"
+	// remoteRestartReconnect reconnects the session and reopens its tunnels on
+	// a remote restart command
+	remoteRestartReconnect = "reconnect"
+	// remoteRestartReload reloads the Caddy config on a remote restart command
+	remoteRestartReload = "reload"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultDrainTimeout   = 5 * time.Second
+	retryInterval         = 10 * time.Second
+)
+
 // Ngrok is a `listener_wrapper` whose address is an ngrok-ingress address
 type Ngrok struct {
-	opts []ngrok.ConnectOption
+	opts     []ngrok.ConnectOption
+	proxyURL *url.URL
 
 	// The user's ngrok authentication token
 	AuthToken string `json:"auth_token,omitempty"`
 
+	// AuthTokenFile is the path of a file holding the user's ngrok
+	// authentication token, e.g. a mounted Docker or Kubernetes secret. The
+	// file is read again on every config load.
+	AuthTokenFile string `json:"auth_token_file,omitempty"`
+
+	// AuthTokenStorage is the key under which the user's ngrok authentication
+	// token is held in the Caddy `storage`. The token is loaded again on every
+	// config load.
+	AuthTokenStorage string `json:"auth_token_storage,omitempty"`
+
 	// The ngrok tunnel type and configuration; defaults to 'tcp'
 	TunnelRaw json.RawMessage `json:"tunnel,omitempty" caddy:"namespace=caddy.listeners.ngrok.tunnels inline_key=type"`
 
@@ -73,7 +123,79 @@ type Ngrok struct {
 	// See the [proxy url parameter in the ngrok docs] for additional details.
 	ProxyURL string `json:"proxy_url,omitempty"`
 
+	// Reconnect configures the delays between the attempts of the session to
+	// reconnect to ngrok after losing its connection, and how many attempts
+	// are made. Every attempt is logged along with the failure causing it.
+	Reconnect *Reconnect `json:"reconnect,omitempty"`
+
+	// Mode is either `replace`, to serve the ngrok tunnel instead of the
+	// listener passed by Caddy, or `both`, to serve connections from both the
+	// tunnel and the listener passed by Caddy, e.g. to keep a site reachable
+	// on the LAN; defaults to `replace`.
+	Mode string `json:"mode,omitempty"`
+
+	// OnFailure decides what happens when the tunnel cannot be established
+	// while loading the config. One of `fail`, `fallback_local`, `retry` or
+	// `fallback_retry`; defaults to `fail`.
+	//
+	// `fail` aborts the config load with the ngrok error, `fallback_local` serves
+	// the listener passed by Caddy instead of the tunnel, and `retry` keeps
+	// trying to establish the tunnel in the background, accepting connections
+	// once it is up. `fallback_retry` serves the listener passed by Caddy right
+	// away and keeps trying to establish the tunnel in the background, serving
+	// the tunnel along with the local listener once it is up; this is handy for
+	// development configs used without internet access. The local listener is
+	// served with `fallback_retry` even when the tunnel is established right
+	// away.
+	OnFailure string `json:"on_failure,omitempty"`
+
+	// ConnectTimeout is how long to wait for the tunnel to be established
+	// before applying the `on_failure` policy; defaults to 10s.
+	ConnectTimeout caddy.Duration `json:"connect_timeout,omitempty"`
+
+	// URLFile is the path of a file to which the public URL of the tunnel is
+	// written once the tunnel is up, e.g. for scripts running end-to-end tests
+	// against it. The file is replaced atomically, and removed once no loaded
+	// config uses it anymore.
+	URLFile string `json:"url_file,omitempty"`
+
+	// URLFileFormat is the format of the `url_file`: `text`, holding only the
+	// URL, or `json`, holding the URL along with the tunnel ID, protocol,
+	// region, metadata and labels; defaults to `text`.
+	URLFileFormat string `json:"url_file_format,omitempty"`
+
+	// DrainTimeout is how long to wait for the connections accepted through
+	// the tunnel to be closed once the tunnel is no longer used by any config,
+	// before its session is closed; defaults to 5s.
+	DrainTimeout caddy.Duration `json:"drain_timeout,omitempty"`
+
+	// RemoteStop is what to do when a stop command is issued for the session
+	// from the ngrok dashboard or API: `close`, to close the tunnels of the
+	// session, or `shutdown`, to gracefully shut Caddy down; defaults to
+	// `close`.
+	RemoteStop string `json:"remote_stop,omitempty"`
+
+	// RemoteRestart is what to do when a restart command is issued for the
+	// session from the ngrok dashboard or API: `reconnect`, to connect a new
+	// session and reopen the tunnels on it, or `reload`, to load the config
+	// Caddy last persisted again; defaults to `reconnect`. Update commands are
+	// always refused.
+	RemoteRestart string `json:"remote_restart,omitempty"`
+
+	// DenyInlineSecrets makes the config fail to load when the `auth_token`
+	// or a secret of the tunnel, e.g. a `basic_auth` password, is written in
+	// it as is rather than referred to with an `{env.*}` or `{file.*}`
+	// placeholder, so that the config returned by `GET /config/` on the admin
+	// API holds no secret. Without it, such secrets are logged as a warning.
+	DenyInlineSecrets bool `json:"deny_inline_secrets,omitempty"`
+
 	tunnel Tunnel
+	events *eventEmitter
+
+	mu          sync.Mutex
+	shared      *sharedTunnel
+	pending     *pendingListener
+	urlFileHeld bool
 
 	ctx context.Context
 	l   *zap.Logger
@@ -83,6 +205,8 @@ type Ngrok struct {
 func (n *Ngrok) Provision(ctx caddy.Context) error {
 	n.ctx = ctx
 	n.l = ctx.Logger()
+	n.events = newEventEmitter(ctx)
+	lastProvisioned.Store(time.Now().UnixNano())
 
 	if n.TunnelRaw == nil {
 		n.TunnelRaw = json.RawMessage(`{"type": "tcp"}`)
@@ -100,15 +224,220 @@ func (n *Ngrok) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("loading ngrok tunnel module: %v", err)
 	}
 
+	if err = n.checkInlineSecrets(); err != nil {
+		return err
+	}
+
 	n.doReplace()
 
+	if err = n.provisionAuthToken(ctx); err != nil {
+		return fmt.Errorf("provisioning ngrok auth token: %v", err)
+	}
+
 	if err = n.provisionOpts(); err != nil {
 		return fmt.Errorf("provisioning ngrok opts: %v", err)
 	}
 
+	if err = n.provisionListener(); err != nil {
+		return fmt.Errorf("establishing ngrok tunnel: %v", err)
+	}
+
 	return nil
 }
 
+func (n *Ngrok) provisionListener() error {
+	switch n.Mode {
+	case "":
+		n.Mode = modeReplace
+	case modeReplace, modeBoth:
+	default:
+		return fmt.Errorf("unrecognized mode %s", n.Mode)
+	}
+
+	switch n.OnFailure {
+	case "":
+		n.OnFailure = onFailureFail
+	case onFailureFail, onFailureFallbackLocal, onFailureRetry, onFailureFallbackRetry:
+	default:
+		return fmt.Errorf("unrecognized on_failure policy %s", n.OnFailure)
+	}
+
+	if n.ConnectTimeout == 0 {
+		n.ConnectTimeout = caddy.Duration(defaultConnectTimeout)
+	}
+
+	if n.DrainTimeout == 0 {
+		n.DrainTimeout = caddy.Duration(defaultDrainTimeout)
+	}
+
+	switch n.URLFileFormat {
+	case "":
+		n.URLFileFormat = urlFileFormatText
+	case urlFileFormatText, urlFileFormatJSON:
+	default:
+		return fmt.Errorf("unrecognized url_file format %s", n.URLFileFormat)
+	}
+
+	switch n.RemoteStop {
+	case "":
+		n.RemoteStop = remoteStopClose
+	case remoteStopClose, remoteStopShutdown:
+	default:
+		return fmt.Errorf("unrecognized remote_stop action %s", n.RemoteStop)
+	}
+
+	switch n.RemoteRestart {
+	case "":
+		n.RemoteRestart = remoteRestartReconnect
+	case remoteRestartReconnect, remoteRestartReload:
+	default:
+		return fmt.Errorf("unrecognized remote_restart action %s", n.RemoteRestart)
+	}
+
+	tun, err := n.acquireTunnel()
+	if err == nil {
+		_, err = n.setTunnel(tun)
+		return err
+	}
+
+	switch n.OnFailure {
+	case onFailureFallbackLocal:
+		n.l.Warn("ngrok tunnel unavailable, serving the local listener instead", zap.Error(err))
+	case onFailureRetry:
+		n.l.Warn("ngrok tunnel unavailable, retrying in the background", zap.Error(err))
+		n.pending = newPendingListener()
+		pendingTunnels.Add(1)
+		go n.retryTunnel()
+	case onFailureFallbackRetry:
+		n.l.Warn("ngrok tunnel unavailable, serving the local listener and retrying in the background", zap.Error(err))
+		n.pending = newPendingListener()
+		pendingTunnels.Add(1)
+		go n.retryTunnel()
+	default:
+		return err
+	}
+
+	return nil
+}
+
+// setTunnel records the tunnel acquired for this config and writes its URL
+// file, returning false if the config was unloaded in the meantime.
+func (n *Ngrok) setTunnel(tun *sharedTunnel) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ctx.Err() != nil {
+		return false, nil
+	}
+
+	n.shared = tun
+	if n.pending != nil {
+		pendingTunnels.Add(-1)
+	}
+
+	if renewable, ok := n.tunnel.(renewableTunnel); ok {
+		renewable.onRenew(n.renewTunnel)
+	}
+
+	tun.hold(n)
+
+	return true, n.writeURLFile(tun)
+}
+
+// tunnelReplaced writes the URL file again once the tunnel used by this config
+// is replaced, e.g. restarted through the admin API, as its URL may change
+func (n *Ngrok) tunnelReplaced(tun *sharedTunnel) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.shared != tun || n.ctx.Err() != nil {
+		return
+	}
+
+	if err := n.writeURLFile(tun); err != nil {
+		n.l.Error("writing ngrok url_file", zap.Error(err))
+	}
+}
+
+// renewTunnel replaces the tunnel used by this config by a new one with its
+// renewed definition
+func (n *Ngrok) renewTunnel() {
+	n.mu.Lock()
+	tun := n.shared
+	n.mu.Unlock()
+
+	if tun == nil || n.ctx.Err() != nil {
+		return
+	}
+
+	if err := tun.redefine(n.ctx, n.tunnel.NgrokTunnel()); err != nil {
+		n.l.Error("restarting ngrok tunnel with its renewed definition", zap.Error(err))
+		return
+	}
+
+	n.l.Info("ngrok tunnel restarted with its renewed definition", zap.String("address", tun.Addr().String()))
+}
+
+// Cleanup implements caddy.CleanerUpper. It releases the tunnel used by this
+// config, which is closed unless the config replacing this one still uses it.
+func (n *Ngrok) Cleanup() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.pending != nil {
+		n.pending.Close()
+		if n.shared == nil {
+			pendingTunnels.Add(-1)
+		}
+	}
+
+	if err := n.releaseURLFile(); err != nil {
+		n.l.Error("removing ngrok url_file", zap.Error(err))
+	}
+
+	if n.shared == nil {
+		return nil
+	}
+
+	n.shared.unhold(n)
+	err := releaseTunnel(n.shared.key)
+	n.shared = nil
+
+	return err
+}
+
+func (n *Ngrok) retryTunnel() {
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.pending.done:
+			return
+		case <-time.After(retryInterval):
+		}
+
+		tun, err := n.acquireTunnel()
+		if err != nil {
+			n.l.Warn("ngrok tunnel unavailable, retrying in the background", zap.Error(err))
+			continue
+		}
+
+		ok, err := n.setTunnel(tun)
+		if !ok {
+			releaseTunnel(tun.key)
+			return
+		}
+		if err != nil {
+			n.l.Error("writing ngrok url_file", zap.Error(err))
+		}
+
+		n.l.Info("ngrok tunnel attached", zap.String("address", tun.Addr().String()))
+		n.pending.attach(tun.listener())
+
+		return
+	}
+}
+
 func (n *Ngrok) provisionOpts() error {
 	simpleVersion, _ := caddy.Version()
 
@@ -140,12 +469,19 @@ func (n *Ngrok) provisionOpts() error {
 
 	n.opts = append(n.opts, ngrok.WithHeartbeatTolerance(time.Duration(n.HeartbeatTolerance)))
 
+	// the proxy is dialed by the sessions themselves, see sessionDialer
 	if n.ProxyURL != "" {
 		url, err := url.Parse(n.ProxyURL)
 		if err != nil {
 			return fmt.Errorf("provisioning proxy_url: %v", err)
 		}
-		n.opts = append(n.opts, ngrok.WithProxyURL(url))
+		n.proxyURL = url
+	}
+
+	if n.Reconnect != nil {
+		if err := n.Reconnect.provision(); err != nil {
+			return fmt.Errorf("provisioning reconnect: %v", err)
+		}
 	}
 
 	return nil
@@ -154,11 +490,13 @@ func (n *Ngrok) provisionOpts() error {
 func (n *Ngrok) doReplace() {
 	repl := caddy.NewReplacer()
 	replaceableFields := []*string{
-		&n.AuthToken,
+		&n.AuthTokenFile,
+		&n.AuthTokenStorage,
 		&n.Metadata,
 		&n.Region,
 		&n.Server,
 		&n.ProxyURL,
+		&n.URLFile,
 	}
 
 	for _, field := range replaceableFields {
@@ -176,20 +514,35 @@ func (*Ngrok) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-// WrapListener return an ngrok listener instead the listener passed by Caddy
-func (n *Ngrok) WrapListener(net.Listener) net.Listener {
-	ln, err := ngrok.Listen(
-		n.ctx,
-		n.tunnel.NgrokTunnel(),
-		n.opts...,
-	)
-	if err != nil {
-		panic(err)
+// WrapListener return an ngrok listener instead the listener passed by Caddy,
+// or along with it in the `both` mode
+func (n *Ngrok) WrapListener(ln net.Listener) net.Listener {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// fallback_retry serves the local listener whether or not the tunnel was
+	// established by the time Caddy wraps it
+	serveLocal := n.Mode == modeBoth || n.OnFailure == onFailureFallbackRetry
+
+	var tunnelLn net.Listener
+	switch {
+	case n.shared != nil:
+		tunnelLn = n.shared.listener()
+	case n.pending != nil:
+		tunnelLn = n.pending
+	default:
+		return ln
 	}
 
-	n.l.Info("ngrok listening", zap.String("address", ln.Addr().String()))
+	if pt, ok := n.tunnel.(proxyProtoTunnel); ok && pt.proxyProto() != config.ProxyProtoNone {
+		tunnelLn = newProxyProtoListener(tunnelLn, pt.proxyProto())
+	}
+
+	if serveLocal && ln != nil {
+		return newMultiListener(ln, tunnelLn)
+	}
 
-	return ln
+	return tunnelLn
 }
 
 func (n *Ngrok) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -205,6 +558,14 @@ func (n *Ngrok) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if !d.AllArgs(&n.AuthToken) {
 					n.AuthToken = ""
 				}
+			case "auth_token_file":
+				if err := n.unmarshalAuthTokenFile(d); err != nil {
+					return err
+				}
+			case "auth_token_storage":
+				if err := n.unmarshalAuthTokenStorage(d); err != nil {
+					return err
+				}
 			case "metadata":
 				if !d.AllArgs(&n.Metadata) {
 					return d.ArgErr()
@@ -229,10 +590,46 @@ func (n *Ngrok) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if !d.AllArgs(&n.ProxyURL) {
 					return d.ArgErr()
 				}
+			case "reconnect":
+				if err := n.unmarshalReconnect(d); err != nil {
+					return err
+				}
 			case "tunnel":
 				if err := n.unmarshalTunnel(d); err != nil {
 					return err
 				}
+			case "mode":
+				if err := n.unmarshalMode(d); err != nil {
+					return err
+				}
+			case "on_failure":
+				if err := n.unmarshalOnFailure(d); err != nil {
+					return err
+				}
+			case "connect_timeout":
+				if err := n.unmarshalConnectTimeout(d); err != nil {
+					return err
+				}
+			case "url_file":
+				if err := n.unmarshalURLFile(d); err != nil {
+					return err
+				}
+			case "drain_timeout":
+				if err := n.unmarshalDrainTimeout(d); err != nil {
+					return err
+				}
+			case "remote_stop":
+				if err := n.unmarshalRemoteStop(d); err != nil {
+					return err
+				}
+			case "remote_restart":
+				if err := n.unmarshalRemoteRestart(d); err != nil {
+					return err
+				}
+			case "deny_inline_secrets":
+				if err := n.unmarshalDenyInlineSecrets(d); err != nil {
+					return err
+				}
 			default:
 				return d.Errf("unrecognized subdirective %s", subdirective)
 			}
@@ -274,6 +671,125 @@ func (n *Ngrok) unmarshalHeartbeatInterval(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+func (n *Ngrok) unmarshalMode(d *caddyfile.Dispenser) error {
+	var mode string
+	if !d.AllArgs(&mode) {
+		return d.ArgErr()
+	}
+
+	switch strings.ToLower(mode) {
+	case modeReplace, modeBoth:
+		n.Mode = strings.ToLower(mode)
+	default:
+		return d.Errf("unrecognized mode %s", mode)
+	}
+
+	return nil
+}
+
+func (n *Ngrok) unmarshalOnFailure(d *caddyfile.Dispenser) error {
+	var policy string
+	if !d.AllArgs(&policy) {
+		return d.ArgErr()
+	}
+
+	switch strings.ToLower(policy) {
+	case onFailureFail, onFailureFallbackLocal, onFailureRetry, onFailureFallbackRetry:
+		n.OnFailure = strings.ToLower(policy)
+	default:
+		return d.Errf("unrecognized on_failure policy %s", policy)
+	}
+
+	return nil
+}
+
+func (n *Ngrok) unmarshalConnectTimeout(d *caddyfile.Dispenser) error {
+	var timeoutStr string
+	if !d.AllArgs(&timeoutStr) {
+		return d.ArgErr()
+	}
+
+	connectTimeout, err := caddy.ParseDuration(timeoutStr)
+	if err != nil {
+		return d.Errf("parsing connect_timeout duration: %v", err)
+	}
+
+	n.ConnectTimeout = caddy.Duration(connectTimeout)
+
+	return nil
+}
+
+func (n *Ngrok) unmarshalURLFile(d *caddyfile.Dispenser) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+
+	n.URLFile = d.Val()
+
+	if d.NextArg() {
+		switch format := strings.ToLower(d.Val()); format {
+		case urlFileFormatText, urlFileFormatJSON:
+			n.URLFileFormat = format
+		default:
+			return d.Errf("unrecognized url_file format %s", d.Val())
+		}
+	}
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	return nil
+}
+
+func (n *Ngrok) unmarshalDrainTimeout(d *caddyfile.Dispenser) error {
+	var timeoutStr string
+	if !d.AllArgs(&timeoutStr) {
+		return d.ArgErr()
+	}
+
+	drainTimeout, err := caddy.ParseDuration(timeoutStr)
+	if err != nil {
+		return d.Errf("parsing drain_timeout duration: %v", err)
+	}
+
+	n.DrainTimeout = caddy.Duration(drainTimeout)
+
+	return nil
+}
+
+func (n *Ngrok) unmarshalRemoteStop(d *caddyfile.Dispenser) error {
+	var action string
+	if !d.AllArgs(&action) {
+		return d.ArgErr()
+	}
+
+	switch strings.ToLower(action) {
+	case remoteStopClose, remoteStopShutdown:
+		n.RemoteStop = strings.ToLower(action)
+	default:
+		return d.Errf("unrecognized remote_stop action %s", action)
+	}
+
+	return nil
+}
+
+func (n *Ngrok) unmarshalRemoteRestart(d *caddyfile.Dispenser) error {
+	var action string
+	if !d.AllArgs(&action) {
+		return d.ArgErr()
+	}
+
+	switch strings.ToLower(action) {
+	case remoteRestartReconnect, remoteRestartReload:
+		n.RemoteRestart = strings.ToLower(action)
+	default:
+		return d.Errf("unrecognized remote_restart action %s", action)
+	}
+
+	return nil
+}
+
 func (n *Ngrok) unmarshalTunnel(d *caddyfile.Dispenser) error {
 	var tunnelName string
 	if !d.Args(&tunnelName) {
@@ -299,6 +815,7 @@ func (n *Ngrok) unmarshalTunnel(d *caddyfile.Dispenser) error {
 var (
 	_ caddy.Module          = (*Ngrok)(nil)
 	_ caddy.Provisioner     = (*Ngrok)(nil)
+	_ caddy.CleanerUpper    = (*Ngrok)(nil)
 	_ caddy.ListenerWrapper = (*Ngrok)(nil)
 	_ caddyfile.Unmarshaler = (*Ngrok)(nil)
 )
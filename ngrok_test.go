@@ -1,12 +1,16 @@
 package ngroklistener
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
 )
 
 func TestParseNgrok(t *testing.T) {
@@ -409,3 +413,372 @@ func TestNgrokMetadata(t *testing.T) {
 	cases.runAll(t)
 
 }
+
+func TestNgrokOnFailure(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "absent",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Empty(t, actual.OnFailure)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.OnFailure, "fail")
+				require.Equal(t, actual.ConnectTimeout, caddy.Duration(10*time.Second))
+				require.Equal(t, actual.DrainTimeout, caddy.Duration(5*time.Second))
+			},
+		},
+		{
+			name: "set on_failure",
+			caddyInput: `ngrok {
+				on_failure fallback_local
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.OnFailure, "fallback_local")
+			},
+		},
+		{
+			name: "set on_failure retry",
+			caddyInput: `ngrok {
+				on_failure retry
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.OnFailure, "retry")
+			},
+		},
+		{
+			name: "set on_failure fallback_retry",
+			caddyInput: `ngrok {
+				on_failure fallback_retry
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.OnFailure, "fallback_retry")
+			},
+		},
+		{
+			name: "on_failure-unrecognized",
+			caddyInput: `ngrok {
+				on_failure explode
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "on_failure-no-arg",
+			caddyInput: `ngrok {
+				on_failure
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "on_failure-too-many-arg",
+			caddyInput: `ngrok {
+				on_failure fail retry
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "set connect_timeout",
+			caddyInput: `ngrok {
+				connect_timeout 30s
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.ConnectTimeout, caddy.Duration(30*time.Second))
+			},
+		},
+		{
+			name: "connect_timeout-parse-err",
+			caddyInput: `ngrok {
+				connect_timeout foo
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "set drain_timeout",
+			caddyInput: `ngrok {
+				drain_timeout 1m
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.DrainTimeout, caddy.Duration(time.Minute))
+			},
+		},
+		{
+			name: "drain_timeout-no-arg",
+			caddyInput: `ngrok {
+				drain_timeout
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "drain_timeout-parse-err",
+			caddyInput: `ngrok {
+				drain_timeout foo
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestNgrokRemoteCommands(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "absent",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Empty(t, actual.RemoteStop)
+				require.Empty(t, actual.RemoteRestart)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.RemoteStop, "close")
+				require.Equal(t, actual.RemoteRestart, "reconnect")
+			},
+		},
+		{
+			name: "set remote_stop and remote_restart",
+			caddyInput: `ngrok {
+				remote_stop shutdown
+				remote_restart reload
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.RemoteStop, "shutdown")
+				require.Equal(t, actual.RemoteRestart, "reload")
+			},
+		},
+		{
+			name: "remote_stop-unrecognized",
+			caddyInput: `ngrok {
+				remote_stop reload
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "remote_stop-no-arg",
+			caddyInput: `ngrok {
+				remote_stop
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "remote_restart-unrecognized",
+			caddyInput: `ngrok {
+				remote_restart shutdown
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "remote_restart-too-many-arg",
+			caddyInput: `ngrok {
+				remote_restart reconnect reload
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestNgrokMode(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "absent",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Empty(t, actual.Mode)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.Mode, "replace")
+			},
+		},
+		{
+			name: "set mode both",
+			caddyInput: `ngrok {
+				mode both
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.Mode, "both")
+			},
+		},
+		{
+			name: "mode-unrecognized",
+			caddyInput: `ngrok {
+				mode either
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "mode-no-arg",
+			caddyInput: `ngrok {
+				mode
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestNgrokWrapListenerBoth(t *testing.T) {
+	sess := withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "mode-both-test", Mode: "both"}
+	provisionNgrok(t, n)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := n.WrapListener(local)
+	require.Equal(t, local.Addr(), ln.Addr())
+
+	localConn, err := net.Dial("tcp", local.Addr().String())
+	require.Nil(t, err)
+	defer localConn.Close()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+	require.Equal(t, localConn.LocalAddr().String(), conn.RemoteAddr().String())
+	conn.Close()
+
+	go sess.last.Load().dial()
+
+	conn, err = ln.Accept()
+	require.Nil(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().Network())
+	conn.Close()
+
+	require.Nil(t, ln.Close())
+
+	_, err = local.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestNgrokListenFailure(t *testing.T) {
+	defer func(orig func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error)) {
+		connect = orig
+	}(connect)
+
+	connect = func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		return nil, errors.New("authentication failed")
+	}
+
+	provision := func(t *testing.T, onFailure string) (*Ngrok, error) {
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(cancel)
+
+		n := &Ngrok{AuthToken: "listen-failure", OnFailure: onFailure}
+		t.Cleanup(func() { n.Cleanup() })
+
+		return n, n.Provision(ctx)
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		_, err := provision(t, "fail")
+		require.ErrorContains(t, err, "authentication failed")
+	})
+
+	t.Run("fallback_local", func(t *testing.T) {
+		n, err := provision(t, "fallback_local")
+		require.Nil(t, err)
+
+		local, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer local.Close()
+
+		require.Equal(t, local, n.WrapListener(local))
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		n, err := provision(t, "retry")
+		require.Nil(t, err)
+
+		ln := n.WrapListener(nil)
+		require.IsType(t, &pendingListener{}, ln)
+		require.Equal(t, "pending", ln.Addr().String())
+		require.Nil(t, ln.Close())
+
+		_, err = ln.Accept()
+		require.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("fallback_retry", func(t *testing.T) {
+		n, err := provision(t, "fallback_retry")
+		require.Nil(t, err)
+
+		local, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+
+		ln := n.WrapListener(local)
+		defer ln.Close()
+		require.IsType(t, &multiListener{}, ln)
+		require.Equal(t, local.Addr(), ln.Addr())
+
+		localConn, err := net.Dial("tcp", local.Addr().String())
+		require.Nil(t, err)
+		defer localConn.Close()
+
+		conn, err := ln.Accept()
+		require.Nil(t, err)
+		conn.Close()
+
+		// the tunnel comes up in the background
+		tun := newFakeTunnel()
+		n.pending.attach(tun)
+
+		go tun.dial()
+
+		conn, err = ln.Accept()
+		require.Nil(t, err)
+		require.Equal(t, "pipe", conn.RemoteAddr().Network())
+		conn.Close()
+	})
+}
+
+func TestNgrokFallbackRetryConnected(t *testing.T) {
+	sess := withCountingSession(t)
+
+	// the tunnel is established before Caddy wraps the listener
+	n := &Ngrok{AuthToken: "fallback-retry-connected", OnFailure: "fallback_retry"}
+	provisionNgrok(t, n)
+	require.NotNil(t, n.shared)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := n.WrapListener(local)
+	defer ln.Close()
+	require.IsType(t, &multiListener{}, ln)
+
+	localConn, err := net.Dial("tcp", local.Addr().String())
+	require.Nil(t, err)
+	defer localConn.Close()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+	require.Equal(t, localConn.LocalAddr().String(), conn.RemoteAddr().String())
+	conn.Close()
+
+	go sess.last.Load().dial()
+
+	conn, err = ln.Accept()
+	require.Nil(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().Network())
+	conn.Close()
+}
+
+func TestNgrokListenTimeout(t *testing.T) {
+	defer func(orig func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error)) {
+		connect = orig
+	}(connect)
+
+	connect = func(ctx context.Context, _ ...ngrok.ConnectOption) (ngrok.Session, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	n := &Ngrok{AuthToken: "listen-timeout", ConnectTimeout: caddy.Duration(10 * time.Millisecond)}
+	err := n.Provision(ctx)
+	require.ErrorContains(t, err, "timed out")
+}
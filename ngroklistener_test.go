@@ -2,16 +2,206 @@ package ngroklistener
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
 	"golang.ngrok.com/ngrok/config"
 )
 
+func TestMain(m *testing.M) {
+	// never reach out to the ngrok service from tests
+	connect = fakeConnect
+
+	os.Exit(m.Run())
+}
+
+// newTestContext returns a context cancelled once the test is done
+func newTestContext(t *testing.T) caddy.Context {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+// testCert describes a self-signed certificate made by newTestCert
+type testCert struct {
+	name string
+	sans []string
+	ca   bool
+
+	// the certificate is valid for an hour around now unless set
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// newTestCert returns the self-signed certificate described by tc, along with
+// the PEM encoding of the certificate and of its private key
+func newTestCert(t *testing.T, tc testCert) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	if tc.notBefore.IsZero() {
+		tc.notBefore = time.Now().Add(-time.Hour)
+	}
+	if tc.notAfter.IsZero() {
+		tc.notAfter = time.Now().Add(time.Hour)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: tc.name},
+		DNSNames:     tc.sans,
+		NotBefore:    tc.notBefore,
+		NotAfter:     tc.notAfter,
+	}
+	if tc.ca {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+
+	return cert, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+// provisionNgrok provisions n in a config of its own, returning the func
+// unloading that config.
+func provisionNgrok(t *testing.T, n *Ngrok) func() {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+
+	var once sync.Once
+	unload := func() {
+		once.Do(func() {
+			cancel()
+			require.Nil(t, n.Cleanup())
+		})
+	}
+	t.Cleanup(unload)
+
+	require.Nil(t, n.Provision(ctx))
+
+	return unload
+}
+
+func fakeConnect(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+	return newFakeSession(), nil
+}
+
+// fakeSession is an in-memory ngrok.Session
+type fakeSession struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{closed: make(chan struct{})}
+}
+
+func (s *fakeSession) Listen(context.Context, config.Tunnel) (ngrok.Tunnel, error) {
+	tun := newFakeTunnel()
+	tun.sess = s
+	return tun, nil
+}
+
+func (s *fakeSession) Warnings() []error { return nil }
+
+func (s *fakeSession) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *fakeSession) isClosed() bool { return isDone(s.closed) }
+
+// fakeTunnel is an in-memory ngrok.Tunnel
+type fakeTunnel struct {
+	sess      ngrok.Session
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeTunnel() *fakeTunnel {
+	return &fakeTunnel{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (t *fakeTunnel) Accept() (net.Conn, error) {
+	select {
+	case <-t.closed:
+		return nil, net.ErrClosed
+	case conn := <-t.conns:
+		return conn, nil
+	}
+}
+
+func (t *fakeTunnel) Close() error {
+	return t.CloseWithContext(context.Background())
+}
+
+func (t *fakeTunnel) CloseWithContext(context.Context) error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+func (t *fakeTunnel) Addr() net.Addr             { return fakeAddr{} }
+func (t *fakeTunnel) ForwardsTo() string         { return "caddy" }
+func (t *fakeTunnel) ID() string                 { return "tn_fake" }
+func (t *fakeTunnel) Labels() map[string]string  { return map[string]string{} }
+func (t *fakeTunnel) Metadata() string           { return "" }
+func (t *fakeTunnel) Proto() string              { return "https" }
+func (t *fakeTunnel) Session() ngrok.Session     { return nil }
+func (t *fakeTunnel) URL() string                { return "https://fake.ngrok.app" }
+func (t *fakeTunnel) isClosed() bool             { return isDone(t.closed) }
+func (t *fakeTunnel) dial() (net.Conn, net.Conn) { return dialPipe(t.conns) }
+
+type fakeAddr struct{}
+
+func (fakeAddr) Network() string { return "tcp" }
+func (fakeAddr) String() string  { return "fake.ngrok.app:443" }
+
+// dialPipe hands one end of an in-memory connection to the accepting side
+func dialPipe(conns chan<- net.Conn) (net.Conn, net.Conn) {
+	server, client := net.Pipe()
+	conns <- server
+	return server, client
+}
+
+func isDone(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
 type TestConfig interface {
 	Provision(caddy.Context) error
 	UnmarshalCaddyfile(*caddyfile.Dispenser) error
@@ -104,6 +294,10 @@ func (gt genericNgrokTest[C]) run(t *testing.T) {
 		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
 		defer cancel()
 
+		if cu, ok := any(ngrok).(caddy.CleanerUpper); ok {
+			defer cu.Cleanup()
+		}
+
 		err = ngrok.Provision(ctx)
 
 		if gt.expectProvisionErr {
@@ -2,6 +2,7 @@ package ngroklistener
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/caddyserver/caddy/v2"
@@ -24,6 +25,12 @@ type oidc struct {
 func (o *oidc) Provision(caddy.Context) error {
 	o.doReplace()
 
+	clientSecret, err := resolveSecret(o.ClientSecret)
+	if err != nil {
+		return fmt.Errorf("resolving oidc client_secret: %v", err)
+	}
+	o.ClientSecret = clientSecret
+
 	if len(o.AllowEmails) > 0 {
 		o.opts = append(o.opts, config.WithAllowOIDCEmail(o.AllowEmails...))
 	}
@@ -73,7 +80,6 @@ func (o *oidc) doReplace() {
 
 	o.IssuerURL = repl.ReplaceKnown(o.IssuerURL, "")
 	o.ClientID = repl.ReplaceKnown(o.ClientID, "")
-	o.ClientSecret = repl.ReplaceKnown(o.ClientSecret, "")
 
 }
 
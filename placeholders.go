@@ -0,0 +1,118 @@
+package ngroklistener
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(new(Placeholders))
+	httpcaddyfile.RegisterHandlerDirective("ngrok_placeholders", parsePlaceholders)
+}
+
+// Placeholders is an HTTP handler which sets the placeholders describing the
+// ngrok tunnel a request was accepted through:
+//
+// Placeholder | Description
+// ------------|-------------
+// `{ngrok.url}` | The public URL of the tunnel
+// `{ngrok.hostname}` | The hostname of the tunnel URL
+// `{ngrok.port}` | The port of the tunnel URL
+// `{ngrok.tunnel_id}` | The ID of the tunnel
+// `{ngrok.proto}` | The protocol of the tunnel, e.g. `https` or `tcp`
+//
+// The placeholders are left unset for requests accepted through other
+// listeners. Labeled tunnels have no URL, so only `{ngrok.tunnel_id}` is set
+// for them.
+type Placeholders struct{}
+
+// CaddyModule implements caddy.Module
+func (*Placeholders) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.ngrok_placeholders",
+		New: func() caddy.Module {
+			return new(Placeholders)
+		},
+	}
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler
+func (*Placeholders) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	conn, _ := r.Context().Value(caddyhttp.ConnCtxKey).(net.Conn)
+	tun, ok := tunnelFromConn(conn)
+	if !ok {
+		return next.ServeHTTP(w, r)
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	for key, value := range tunnelPlaceholders(tun) {
+		repl.Set(key, value)
+	}
+
+	return next.ServeHTTP(w, r)
+}
+
+// tunnelPlaceholders returns the placeholder values describing tun
+func tunnelPlaceholders(tun *sharedTunnel) map[string]string {
+	placeholders := map[string]string{
+		"ngrok.tunnel_id": tun.ID(),
+		"ngrok.proto":     tun.Proto(),
+	}
+
+	if tun.URL() == "" {
+		return placeholders
+	}
+
+	placeholders["ngrok.url"] = tun.URL()
+
+	if u, err := url.Parse(tun.URL()); err == nil {
+		placeholders["ngrok.hostname"] = u.Hostname()
+		placeholders["ngrok.port"] = u.Port()
+
+		if u.Port() == "" {
+			placeholders["ngrok.port"] = defaultPorts[u.Scheme]
+		}
+	}
+
+	return placeholders
+}
+
+// defaultPorts are the ports of the tunnel URLs not carrying one
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"tls":   "443",
+}
+
+func (*Placeholders) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			return d.Errf("unrecognized subdirective %s", d.Val())
+		}
+	}
+
+	return nil
+}
+
+func parsePlaceholders(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	p := new(Placeholders)
+	err := p.UnmarshalCaddyfile(h.Dispenser)
+
+	return p, err
+}
+
+var (
+	_ caddy.Module                = (*Placeholders)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Placeholders)(nil)
+	_ caddyfile.Unmarshaler       = (*Placeholders)(nil)
+)
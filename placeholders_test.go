@@ -0,0 +1,129 @@
+package ngroklistener
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+)
+
+// urlTunnel is a fake tunnel with a given URL
+type urlTunnel struct {
+	*fakeTunnel
+
+	url   string
+	proto string
+}
+
+func (t *urlTunnel) URL() string   { return t.url }
+func (t *urlTunnel) Proto() string { return t.proto }
+
+func servePlaceholders(t *testing.T, conn net.Conn) *caddy.Replacer {
+	repl := caddy.NewReplacer()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)
+	ctx = context.WithValue(ctx, caddyhttp.ConnCtxKey, conn)
+	req = req.WithContext(ctx)
+
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	require.Nil(t, new(Placeholders).ServeHTTP(httptest.NewRecorder(), req, next))
+
+	return repl
+}
+
+func TestPlaceholders(t *testing.T) {
+	cases := []struct {
+		name     string
+		url      string
+		proto    string
+		expected map[string]string
+	}{
+		{
+			name:  "https",
+			url:   "https://foo.ngrok.app",
+			proto: "https",
+			expected: map[string]string{
+				"ngrok.url":       "https://foo.ngrok.app",
+				"ngrok.hostname":  "foo.ngrok.app",
+				"ngrok.port":      "443",
+				"ngrok.tunnel_id": "tn_fake",
+				"ngrok.proto":     "https",
+			},
+		},
+		{
+			name:  "tcp",
+			url:   "tcp://0.tcp.ngrok.io:12345",
+			proto: "tcp",
+			expected: map[string]string{
+				"ngrok.url":       "tcp://0.tcp.ngrok.io:12345",
+				"ngrok.hostname":  "0.tcp.ngrok.io",
+				"ngrok.port":      "12345",
+				"ngrok.tunnel_id": "tn_fake",
+				"ngrok.proto":     "tcp",
+			},
+		},
+		{
+			name: "labeled",
+			expected: map[string]string{
+				"ngrok.tunnel_id": "tn_fake",
+				"ngrok.proto":     "",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tun := newSharedTunnel(&urlTunnel{fakeTunnel: newFakeTunnel(), url: tc.url, proto: tc.proto}, "", &session{}, nil)
+			defer tun.Close()
+
+			require.Equal(t, tc.expected, tunnelPlaceholders(tun))
+		})
+	}
+}
+
+func TestPlaceholdersHandler(t *testing.T) {
+	tun := newSharedTunnel(&urlTunnel{fakeTunnel: newFakeTunnel(), url: "https://foo.ngrok.app", proto: "https"}, "", &session{}, nil)
+	defer tun.Close()
+
+	go tun.tunnel().(*urlTunnel).dial()
+	conn, err := tun.listener().Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+
+	t.Run("ngrok connection", func(t *testing.T) {
+		repl := servePlaceholders(t, conn)
+		require.Equal(t, "https://foo.ngrok.app/login", repl.ReplaceAll("{ngrok.url}/login", ""))
+		require.Equal(t, "foo.ngrok.app:443", repl.ReplaceAll("{ngrok.hostname}:{ngrok.port}", ""))
+	})
+
+	t.Run("tls-wrapped ngrok connection", func(t *testing.T) {
+		repl := servePlaceholders(t, tls.Server(conn, &tls.Config{}))
+		require.Equal(t, "tn_fake", repl.ReplaceAll("{ngrok.tunnel_id}", ""))
+	})
+
+	t.Run("local connection", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		repl := servePlaceholders(t, server)
+		_, ok := repl.Get("ngrok.url")
+		require.False(t, ok)
+	})
+}
+
+func TestParsePlaceholders(t *testing.T) {
+	require.Nil(t, new(Placeholders).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`ngrok_placeholders`)))
+	require.NotNil(t, new(Placeholders).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`ngrok_placeholders arg1`)))
+	require.NotNil(t, new(Placeholders).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`ngrok_placeholders {
+		directive
+	}`)))
+}
@@ -0,0 +1,277 @@
+package ngroklistener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.ngrok.com/ngrok/config"
+)
+
+// proxyHeaderTimeout bounds how long reading the PROXY header of a connection
+// may take
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts the PROXY protocol v2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoTunnel is implemented by the tunnels whose connections may start
+// with a PROXY protocol header
+type proxyProtoTunnel interface {
+	// proxyProto returns the version of the PROXY protocol the edge speaks
+	proxyProto() config.ProxyProtoVersion
+}
+
+// parseProxyProto parses the `proxy_protocol` option of a tunnel
+func parseProxyProto(version string) (config.ProxyProtoVersion, error) {
+	switch version {
+	case "":
+		return config.ProxyProtoNone, nil
+	case "v1", "1":
+		return config.ProxyProtoV1, nil
+	case "v2", "2":
+		return config.ProxyProtoV2, nil
+	default:
+		return config.ProxyProtoNone, fmt.Errorf("unsupported proxy_protocol version %s, expected v1 or v2", version)
+	}
+}
+
+// proxyProtoListener reads the PROXY header the ngrok edge prepends to the
+// connections, so that their remote address is the one of the client
+type proxyProtoListener struct {
+	net.Listener
+
+	version config.ProxyProtoVersion
+}
+
+func newProxyProtoListener(ln net.Listener, version config.ProxyProtoVersion) net.Listener {
+	return &proxyProtoListener{Listener: ln, version: version}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtoConn{Conn: conn, version: l.version}, nil
+}
+
+// proxyProtoConn reads the PROXY header on the first read or address lookup,
+// rather than in Accept, so that a slow client does not hold the listener.
+type proxyProtoConn struct {
+	net.Conn
+
+	version config.ProxyProtoVersion
+
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+	err    error
+
+	// the read deadline set by the user of the connection, restored once the
+	// header is read
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+
+		c.r = bufio.NewReader(c.Conn)
+		switch c.version {
+		case config.ProxyProtoV1:
+			c.remote, c.local, c.err = readProxyV1Header(c.r)
+		case config.ProxyProtoV2:
+			c.remote, c.local, c.err = readProxyV2Header(c.r)
+		}
+		if c.err != nil {
+			c.err = fmt.Errorf("reading PROXY header: %v", c.err)
+		}
+
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client given by the PROXY header
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+
+	return c.remote
+}
+
+// LocalAddr returns the address the client connected to given by the PROXY
+// header
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.local == nil {
+		return c.Conn.LocalAddr()
+	}
+
+	return c.local
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// NetConn returns the connection accepted from the ngrok tunnel.
+func (c *proxyProtoConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readProxyV1Header reads a human-readable PROXY header, e.g.
+// `PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n`. The addresses are nil
+// for the UNKNOWN protocol.
+func readProxyV1Header(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// a v1 header is at most 107 bytes long
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, nil, errors.New("v1 header too long")
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, errors.New("invalid v1 header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, fmt.Errorf("unsupported v1 protocol %s", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, nil, errors.New("invalid v1 header")
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid v1 source address: %v", err)
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid v1 destination address: %v", err)
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid IP %s", ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", port)
+	}
+
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readProxyV2Header reads a binary PROXY header. The addresses are nil for
+// the LOCAL command and the unsupported address families.
+func readProxyV2Header(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, nil, errors.New("invalid v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", header[12]&0x0f)
+	}
+
+	var size int
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("v2 addresses too short")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+
+	return src, dst, nil
+}
+
+var (
+	_ net.Listener = (*proxyProtoListener)(nil)
+	_ net.Conn     = (*proxyProtoConn)(nil)
+)
@@ -0,0 +1,157 @@
+package ngroklistener
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header returns a PROXY protocol v2 header for the command, address
+// family and addresses
+func proxyV2Header(command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+
+	return append(header, addrs...)
+}
+
+func TestProxyProtoConn(t *testing.T) {
+	ipv4Addrs := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6Addrs := append(append(append(
+		net.ParseIP("2001:db8::1").To16(),
+		net.ParseIP("2001:db8::2").To16()...),
+		0xdc, 0x04, 0x01, 0xbb),
+		// a TLV following the addresses is skipped
+		0x04, 0x00, 0x01, 0x00)
+
+	cases := []struct {
+		name         string
+		tunnel       string
+		header       []byte
+		expectRemote string
+		expectLocal  string
+		expectErr    bool
+	}{
+		{
+			name:         "v1-tcp4",
+			tunnel:       `{"type":"tcp","proxy_protocol":"v1"}`,
+			header:       []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			expectRemote: "192.0.2.1:56324",
+			expectLocal:  "198.51.100.1:443",
+		},
+		{
+			name:         "v1-tcp6",
+			tunnel:       `{"type":"tls","proxy_protocol":"v1"}`,
+			header:       []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			expectRemote: "[2001:db8::1]:56324",
+			expectLocal:  "[2001:db8::2]:443",
+		},
+		{
+			name:         "v1-unknown",
+			tunnel:       `{"type":"tcp","proxy_protocol":"v1"}`,
+			header:       []byte("PROXY UNKNOWN\r\n"),
+			expectRemote: "pipe",
+			expectLocal:  "pipe",
+		},
+		{
+			name:      "v1-malformed",
+			tunnel:    `{"type":"tcp","proxy_protocol":"v1"}`,
+			header:    []byte("PROXY TCP4 192.0.2.1\r\n"),
+			expectErr: true,
+		},
+		{
+			name:      "v1-missing",
+			tunnel:    `{"type":"tcp","proxy_protocol":"v1"}`,
+			header:    []byte("GET / HTTP/1.1\r\n"),
+			expectErr: true,
+		},
+		{
+			name:         "v2-ipv4",
+			tunnel:       `{"type":"tcp","proxy_protocol":"v2"}`,
+			header:       proxyV2Header(0x1, 0x11, ipv4Addrs),
+			expectRemote: "192.0.2.1:56324",
+			expectLocal:  "198.51.100.1:443",
+		},
+		{
+			name:         "v2-ipv6",
+			tunnel:       `{"type":"tls","proxy_protocol":"v2"}`,
+			header:       proxyV2Header(0x1, 0x21, ipv6Addrs),
+			expectRemote: "[2001:db8::1]:56324",
+			expectLocal:  "[2001:db8::2]:443",
+		},
+		{
+			name:         "v2-local",
+			tunnel:       `{"type":"tcp","proxy_protocol":"v2"}`,
+			header:       proxyV2Header(0x0, 0x00, nil),
+			expectRemote: "pipe",
+			expectLocal:  "pipe",
+		},
+		{
+			name:      "v2-missing",
+			tunnel:    `{"type":"tcp","proxy_protocol":"v2"}`,
+			header:    []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sess := withCountingSession(t)
+
+			n := &Ngrok{AuthToken: "proxy-protocol-test", TunnelRaw: []byte(tc.tunnel)}
+			provisionNgrok(t, n)
+			ln := n.WrapListener(nil)
+
+			_, client := sess.last.Load().dial()
+			defer client.Close()
+			go func() {
+				client.Write(tc.header)
+				client.Write([]byte("hello"))
+			}()
+
+			conn, err := ln.Accept()
+			require.Nil(t, err)
+			defer conn.Close()
+
+			// the header is read lazily, and not handed to the reader
+			body := make([]byte, 5)
+			_, err = io.ReadFull(conn, body)
+			if tc.expectErr {
+				require.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, "hello", string(body))
+
+			require.Equal(t, tc.expectRemote, conn.RemoteAddr().String())
+			require.Equal(t, tc.expectLocal, conn.LocalAddr().String())
+
+			// the connection is still known to come from the tunnel
+			shared, ok := tunnelFromConn(conn)
+			require.True(t, ok)
+			require.Same(t, n.shared, shared)
+		})
+	}
+}
+
+func TestProxyProtoDisabled(t *testing.T) {
+	sess := withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "proxy-protocol-disabled-test", TunnelRaw: []byte(`{"type":"tcp"}`)}
+	provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+
+	_, client := sess.last.Load().dial()
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, ok := conn.(*proxyProtoConn)
+	require.False(t, ok)
+}
@@ -0,0 +1,150 @@
+package ngroklistener
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// The reconnect settings used when the `reconnect` block omits them
+const (
+	defaultReconnectInitialDelay = time.Second
+	defaultReconnectMaxDelay     = time.Minute
+	defaultReconnectMultiplier   = 2
+)
+
+// Reconnect configures how long the session waits before each attempt to
+// reconnect to ngrok after losing its connection. The delays are waited on
+// top of the ones ngrok-go waits between its own attempts, which go from
+// 500ms to 30s.
+type Reconnect struct {
+	// InitialDelay is how long to wait before the first attempt; defaults to 1s.
+	InitialDelay caddy.Duration `json:"initial_delay,omitempty"`
+
+	// MaxDelay caps the delay the session waits before an attempt, jitter
+	// included; defaults to 1m. ngrok-go's own delay, up to 30s, adds to it, so
+	// two attempts may be up to MaxDelay plus 30s apart.
+	MaxDelay caddy.Duration `json:"max_delay,omitempty"`
+
+	// Multiplier is the factor by which the delay grows after each failed
+	// attempt; defaults to 2.
+	Multiplier float64 `json:"multiplier,omitempty"`
+
+	// Jitter randomizes each delay by up to this fraction of it, between 0
+	// and 1, so that many instances losing their connection at once do not
+	// reconnect in lockstep.
+	Jitter float64 `json:"jitter,omitempty"`
+
+	// MaxAttempts is the number of failed attempts after which the session
+	// gives up reconnecting; 0, the default, retries forever.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+}
+
+func (r *Reconnect) provision() error {
+	if r.InitialDelay == 0 {
+		r.InitialDelay = caddy.Duration(defaultReconnectInitialDelay)
+	}
+
+	if r.MaxDelay == 0 {
+		r.MaxDelay = caddy.Duration(defaultReconnectMaxDelay)
+	}
+
+	if r.Multiplier == 0 {
+		r.Multiplier = defaultReconnectMultiplier
+	}
+
+	switch {
+	case r.InitialDelay < 0:
+		return fmt.Errorf("initial_delay must not be negative")
+	case r.MaxDelay < r.InitialDelay:
+		return fmt.Errorf("max_delay must not be shorter than initial_delay")
+	case r.Multiplier < 1:
+		return fmt.Errorf("multiplier must be at least 1")
+	case r.Jitter < 0 || r.Jitter > 1:
+		return fmt.Errorf("jitter must be between 0 and 1")
+	case r.MaxAttempts < 0:
+		return fmt.Errorf("max_attempts must not be negative")
+	}
+
+	return nil
+}
+
+// delay returns how long to wait before the given attempt, counted from 1
+func (r *Reconnect) delay(attempt int) time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	delay := float64(r.InitialDelay) * math.Pow(r.Multiplier, float64(attempt-1))
+	delay = math.Min(delay, float64(r.MaxDelay))
+
+	if r.Jitter > 0 {
+		delay += delay * r.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(math.Min(delay, float64(r.MaxDelay)))
+}
+
+// exhausted reports whether the session must give up before the given
+// attempt, counted from 1
+func (r *Reconnect) exhausted(attempt int) bool {
+	return r != nil && r.MaxAttempts > 0 && attempt > r.MaxAttempts
+}
+
+func (n *Ngrok) unmarshalReconnect(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	n.Reconnect = new(Reconnect)
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+
+		var value string
+		if !d.AllArgs(&value) {
+			return d.ArgErr()
+		}
+
+		switch subdirective {
+		case "initial_delay", "max_delay":
+			delay, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("parsing %s duration: %v", subdirective, err)
+			}
+
+			if subdirective == "initial_delay" {
+				n.Reconnect.InitialDelay = caddy.Duration(delay)
+			} else {
+				n.Reconnect.MaxDelay = caddy.Duration(delay)
+			}
+		case "multiplier", "jitter":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return d.Errf("parsing %s: %v", subdirective, err)
+			}
+
+			if subdirective == "multiplier" {
+				n.Reconnect.Multiplier = f
+			} else {
+				n.Reconnect.Jitter = f
+			}
+		case "max_attempts":
+			attempts, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("parsing max_attempts: %v", err)
+			}
+
+			n.Reconnect.MaxAttempts = attempts
+		default:
+			return d.Errf("unrecognized reconnect subdirective %s", subdirective)
+		}
+	}
+
+	return nil
+}
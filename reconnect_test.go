@@ -0,0 +1,183 @@
+package ngroklistener
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNgrokReconnect(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "absent",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Nil(t, actual.Reconnect)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Nil(t, actual.Reconnect)
+			},
+		},
+		{
+			name: "defaults",
+			caddyInput: `ngrok {
+				reconnect
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, &Reconnect{}, actual.Reconnect)
+			},
+			expectedOptsFunc: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, &Reconnect{
+					InitialDelay: caddy.Duration(time.Second),
+					MaxDelay:     caddy.Duration(time.Minute),
+					Multiplier:   2,
+				}, actual.Reconnect)
+			},
+		},
+		{
+			name: "set all",
+			caddyInput: `ngrok {
+				reconnect {
+					initial_delay 2s
+					max_delay 5m
+					multiplier 1.5
+					jitter 0.2
+					max_attempts 10
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, &Reconnect{
+					InitialDelay: caddy.Duration(2 * time.Second),
+					MaxDelay:     caddy.Duration(5 * time.Minute),
+					Multiplier:   1.5,
+					Jitter:       0.2,
+					MaxAttempts:  10,
+				}, actual.Reconnect)
+			},
+		},
+		{
+			name: "reconnect-arg",
+			caddyInput: `ngrok {
+				reconnect 1s
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "reconnect-unrecognized",
+			caddyInput: `ngrok {
+				reconnect {
+					forever
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "reconnect-parse-err",
+			caddyInput: `ngrok {
+				reconnect {
+					multiplier twice
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "reconnect-no-arg",
+			caddyInput: `ngrok {
+				reconnect {
+					max_attempts
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "reconnect-jitter-out-of-range",
+			caddyInput: `ngrok {
+				reconnect {
+					jitter 2
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *Ngrok) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "reconnect-max-delay-too-short",
+			caddyInput: `ngrok {
+				reconnect {
+					initial_delay 1m
+					max_delay 1s
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *Ngrok) {},
+			expectProvisionErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestReconnectDelay(t *testing.T) {
+	r := &Reconnect{MaxDelay: caddy.Duration(5 * time.Second)}
+	require.Nil(t, r.provision())
+
+	require.Equal(t, time.Second, r.delay(1))
+	require.Equal(t, 2*time.Second, r.delay(2))
+	require.Equal(t, 4*time.Second, r.delay(3))
+	require.Equal(t, 5*time.Second, r.delay(4))
+	require.Equal(t, 5*time.Second, r.delay(100))
+
+	r.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := r.delay(2)
+		require.GreaterOrEqual(t, delay, time.Second)
+		require.LessOrEqual(t, delay, 3*time.Second)
+	}
+
+	var none *Reconnect
+	require.Zero(t, none.delay(3))
+	require.False(t, none.exhausted(1000))
+}
+
+func TestSessionDialerBackoff(t *testing.T) {
+	gaveUp := false
+	d := &sessionDialer{
+		backoff: &Reconnect{
+			InitialDelay: caddy.Duration(time.Millisecond),
+			MaxDelay:     caddy.Duration(time.Millisecond),
+			Multiplier:   1,
+			MaxAttempts:  2,
+		},
+		giveUp: func() { gaveUp = true },
+		l:      zap.NewNop(),
+	}
+
+	// the first connection is dialed right away
+	require.Nil(t, d.wait(context.Background()))
+	require.Zero(t, d.attempts)
+
+	d.connected()
+	d.failed(errors.New("connection reset"))
+
+	require.Nil(t, d.wait(context.Background()))
+	require.Nil(t, d.wait(context.Background()))
+	require.Equal(t, 2, d.attempts)
+
+	err := d.wait(context.Background())
+	require.ErrorContains(t, err, "connection reset")
+	require.True(t, gaveUp)
+
+	// a successful reconnect resets the attempts
+	d.connected()
+	require.Zero(t, d.attempts)
+	require.Nil(t, d.cause)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.backoff.InitialDelay = caddy.Duration(time.Hour)
+	d.backoff.MaxDelay = caddy.Duration(time.Hour)
+	require.ErrorIs(t, d.wait(ctx), context.Canceled)
+}
@@ -0,0 +1,214 @@
+package ngroklistener
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	"golang.ngrok.com/ngrok"
+)
+
+// The commands ngrok can issue for a session from its dashboard or API
+const (
+	remoteCommandStop    = "stop"
+	remoteCommandRestart = "restart"
+	remoteCommandUpdate  = "update"
+)
+
+// shutdown gracefully shuts Caddy down and exits, the way the admin API's
+// stop endpoint does; swapped out in tests. Caddy is stopped in the
+// background, as stopping it closes the ngrok session whose handler calls
+// shutdown.
+var shutdown = func() error {
+	go func() {
+		logger := caddy.Log().Named("ngrok")
+		exitCode := caddy.ExitCodeSuccess
+		if err := caddy.Stop(); err != nil {
+			logger.Error("failed to stop apps", zap.Error(err))
+			exitCode = caddy.ExitCodeFailedQuit
+		}
+
+		certmagic.CleanUpOwnLocks(context.Background(), logger)
+
+		os.Exit(exitCode)
+	}()
+
+	return nil
+}
+
+// reload loads cfgJSON as the new Caddy config; swapped out in tests.
+var reload = func(cfgJSON []byte) error {
+	return caddy.Load(cfgJSON, true)
+}
+
+// lastProvisioned is when an ngrok listener wrapper was last provisioned, in
+// Unix nanoseconds. The config Caddy persists afterwards is the loaded one.
+var lastProvisioned atomic.Int64
+
+// persistedConfig returns the config Caddy persisted when loading the
+// current one.
+func persistedConfig() ([]byte, error) {
+	info, err := os.Stat(caddy.ConfigAutosavePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading persisted config: %v", err)
+	}
+
+	if info.ModTime().UnixNano() < lastProvisioned.Load() {
+		return nil, fmt.Errorf("the persisted config is older than the loaded one; is config persistence disabled?")
+	}
+
+	cfgJSON, err := os.ReadFile(caddy.ConfigAutosavePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading persisted config: %v", err)
+	}
+
+	return cfgJSON, nil
+}
+
+// onStop handles the stop command. ngrok-go closes the session once the
+// handler returns without error.
+func (s *session) onStop(context.Context, ngrok.Session) error {
+	var err error
+
+	switch s.remoteStop {
+	case remoteStopShutdown:
+		err = shutdown()
+	default:
+		s.retire()
+
+		go func() {
+			for _, tun := range sessionTunnels(s.key) {
+				if closed, err := tun.retire(); closed {
+					tun.events.emit(eventTunnelClosed, tun.eventData(err))
+				}
+			}
+		}()
+	}
+
+	s.remoteCommand(remoteCommandStop, s.remoteStop, err)
+
+	return err
+}
+
+// onRestart handles the restart command. ngrok-go closes the session once
+// the handler returns without error, so the handler must not block until the
+// session is replaced.
+func (s *session) onRestart(context.Context, ngrok.Session) error {
+	var err error
+
+	switch s.remoteRestart {
+	case remoteRestartReload:
+		var cfgJSON []byte
+		if cfgJSON, err = persistedConfig(); err == nil {
+			// the reloaded config must not reuse the closed session
+			s.retire()
+
+			go func() {
+				if err := reload(cfgJSON); err != nil {
+					s.l.Error("reloading config on ngrok restart command", zap.Error(err))
+				}
+			}()
+		}
+	default:
+		tuns := sessionTunnels(s.key)
+		for _, tun := range tuns {
+			tun.expectReplace()
+		}
+
+		go s.reestablish(tuns)
+	}
+
+	s.remoteCommand(remoteCommandRestart, s.remoteRestart, err)
+
+	return err
+}
+
+// onUpdate refuses the update command, as Caddy is updated by other means
+func (s *session) onUpdate(context.Context, ngrok.Session) error {
+	err := fmt.Errorf("updates of Caddy are not managed through ngrok")
+
+	s.remoteCommand(remoteCommandUpdate, "refuse", err)
+
+	return err
+}
+
+// remoteCommand logs a command issued by ngrok and emits it as an event
+func (s *session) remoteCommand(command, action string, err error) {
+	if err != nil {
+		s.l.Warn("ngrok remote command failed",
+			zap.String("command", command),
+			zap.String("action", action),
+			zap.Error(err),
+		)
+	} else {
+		s.l.Info("ngrok remote command",
+			zap.String("command", command),
+			zap.String("action", action),
+		)
+	}
+
+	s.events.emit(eventRemoteCommand, map[string]any{
+		"command": command,
+		"action":  action,
+		"region":  s.region,
+		"server":  s.server,
+		"error":   errString(err),
+	})
+}
+
+// retire keeps the configs loaded from now on from reusing the session, as it
+// is about to be closed by ngrok-go.
+func (s *session) retire() {
+	retiredSessions.Store(s.key, struct{}{})
+}
+
+// reestablish connects a new ngrok session in place of the current one and
+// reopens the given tunnels on it. The new session is a new generation of the
+// session, see connectOpts.
+func (s *session) reestablish(tuns []*sharedTunnel) {
+	start := time.Now()
+
+	// the handlers of the ngrok session being replaced are ignored from now on
+	s.gen.Add(1)
+
+	sess, err := connect(s.ctx, s.connectOpts()...)
+	if err != nil {
+		s.l.Error("reconnecting ngrok session", zap.Error(err))
+		for _, tun := range tuns {
+			tun.endReplace()
+		}
+		return
+	}
+
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		// the session was released in the meantime
+		s.mu.Unlock()
+		sess.Close()
+		for _, tun := range tuns {
+			tun.endReplace()
+		}
+		return
+	}
+	previous := s.current.Swap(&sess)
+	s.mu.Unlock()
+
+	for _, tun := range tuns {
+		if err := tun.restart(s.ctx); err != nil {
+			s.l.Error("reopening ngrok tunnel", zap.String("url", tun.URL()), zap.Error(err))
+			tun.endReplace()
+			continue
+		}
+
+		tun.events.emit(eventTunnelStarted, tun.eventData(nil))
+	}
+
+	(*previous).Close()
+
+	s.l.Info("ngrok session reconnected", zap.Int("tunnels", len(tuns)), zap.Duration("duration", time.Since(start)))
+}
@@ -0,0 +1,188 @@
+package ngroklistener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
+)
+
+// withSessionPerConnect makes every connect return a new counting session,
+// returning the connected sessions
+func withSessionPerConnect(t *testing.T) func() []*countingSession {
+	orig := connect
+	t.Cleanup(func() { connect = orig })
+
+	var mu sync.Mutex
+	var connected []*countingSession
+	connect = func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		sess := &countingSession{fakeSession: newFakeSession()}
+		connected = append(connected, sess)
+		return sess, nil
+	}
+
+	return func() []*countingSession {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]*countingSession(nil), connected...)
+	}
+}
+
+func TestRemoteStopClose(t *testing.T) {
+	sess := withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "remote-stop-test"}
+	provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+	key := n.sessionKey()
+
+	require.Nil(t, n.shared.session().onStop(context.Background(), nil))
+	require.Eventually(t, sess.last.Load().isClosed, time.Second, time.Millisecond)
+
+	_, err := ln.Accept()
+	require.NotNil(t, err)
+
+	// the configs loaded afterwards connect a new session
+	require.NotEqual(t, key, n.sessionKey())
+}
+
+func TestRemoteStopShutdown(t *testing.T) {
+	withCountingSession(t)
+
+	orig := shutdown
+	t.Cleanup(func() { shutdown = orig })
+
+	shutdowns := 0
+	shutdown = func() error {
+		shutdowns++
+		return nil
+	}
+
+	n := &Ngrok{AuthToken: "remote-shutdown-test", RemoteStop: "shutdown"}
+	provisionNgrok(t, n)
+	key := n.sessionKey()
+
+	require.Nil(t, n.shared.session().onStop(context.Background(), nil))
+	require.Equal(t, 1, shutdowns)
+	require.Equal(t, key, n.sessionKey())
+}
+
+func TestRemoteRestartReconnect(t *testing.T) {
+	connected := withSessionPerConnect(t)
+
+	n := &Ngrok{AuthToken: "remote-reconnect-test"}
+	provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	oldSess := connected()[0]
+	oldTun := oldSess.last.Load()
+
+	require.Nil(t, n.shared.session().onRestart(context.Background(), nil))
+
+	// ngrok-go closes the session once the handler returns
+	oldTun.Close()
+
+	require.Eventually(t, func() bool { return len(connected()) == 2 }, time.Second, time.Millisecond)
+	newSess := connected()[1]
+	require.Eventually(t, func() bool { return newSess.last.Load() != nil }, time.Second, time.Millisecond)
+	require.Eventually(t, oldSess.isClosed, time.Second, time.Millisecond)
+
+	// the pending Accept is served by the tunnel of the new session
+	_, client := newSess.last.Load().dial()
+	defer client.Close()
+	conn := <-accepted
+	require.NotNil(t, conn)
+	require.Nil(t, conn.Close())
+}
+
+func TestRemoteRestartReload(t *testing.T) {
+	withCountingSession(t)
+
+	origReload, origPath := reload, caddy.ConfigAutosavePath
+	t.Cleanup(func() { reload, caddy.ConfigAutosavePath = origReload, origPath })
+
+	reloaded := make(chan []byte, 1)
+	reload = func(cfgJSON []byte) error {
+		reloaded <- cfgJSON
+		return nil
+	}
+	caddy.ConfigAutosavePath = filepath.Join(t.TempDir(), "autosave.json")
+
+	n := &Ngrok{AuthToken: "remote-reload-test", RemoteRestart: "reload"}
+	provisionNgrok(t, n)
+	key := n.sessionKey()
+
+	// nothing persisted
+	require.NotNil(t, n.shared.session().onRestart(context.Background(), nil))
+	require.Equal(t, key, n.sessionKey())
+
+	// persisted before the current config was loaded
+	require.Nil(t, os.WriteFile(caddy.ConfigAutosavePath, []byte(`{"apps":{}}`), 0o600))
+	stale := time.Unix(0, lastProvisioned.Load()).Add(-time.Minute)
+	require.Nil(t, os.Chtimes(caddy.ConfigAutosavePath, stale, stale))
+	require.NotNil(t, n.shared.session().onRestart(context.Background(), nil))
+
+	now := time.Now()
+	require.Nil(t, os.Chtimes(caddy.ConfigAutosavePath, now, now))
+	require.Nil(t, n.shared.session().onRestart(context.Background(), nil))
+	require.Equal(t, `{"apps":{}}`, string(<-reloaded))
+	require.NotEqual(t, key, n.sessionKey())
+}
+
+func TestRemoteUpdate(t *testing.T) {
+	rec := &eventsRecorder{}
+
+	s := &session{l: newTestContext(t).Logger()}
+	s.events.Store(&eventEmitter{app: rec})
+
+	require.NotNil(t, s.onUpdate(context.Background(), nil))
+
+	events := rec.recorded()
+	require.Len(t, events, 1)
+	require.Equal(t, eventRemoteCommand, events[0].name)
+	require.Equal(t, "update", events[0].data["command"])
+	require.Equal(t, "refuse", events[0].data["action"])
+	require.NotEmpty(t, events[0].data["error"])
+}
+
+func TestRemoteRestartReplacedHandlers(t *testing.T) {
+	withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "remote-replaced-handlers-test"}
+	provisionNgrok(t, n)
+	sess := n.shared.session()
+
+	replaced := sess.handlers()
+	sess.gen.Add(1)
+	current := sess.handlers()
+
+	current.onConnect(context.Background(), nil)
+	require.True(t, sess.connected.Load())
+
+	// ngrok-go tears the replaced session down after the new one connected
+	replaced.onDisconnect(context.Background(), nil, errors.New("session closed"))
+	require.True(t, sess.connected.Load())
+	require.Equal(t, 1.0, testutil.ToFloat64(ngrokMetrics.sessionConnected.WithLabelValues(sess.id, sess.region)))
+
+	current.onDisconnect(context.Background(), nil, errors.New("connection reset"))
+	require.False(t, sess.connected.Load())
+}
@@ -0,0 +1,93 @@
+package ngroklistener
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// secretsTunnel is implemented by the tunnels whose definition holds secrets
+type secretsTunnel interface {
+	// inlineSecrets names the secrets written in the config as is
+	inlineSecrets() []string
+}
+
+// inlineSecret reports whether the secret is written in the config as is,
+// rather than referred to with an {env.*} or {file.*} placeholder. The
+// environment variables of the Caddyfile, e.g. {$NGROK_AUTHTOKEN}, are
+// substituted when adapting it, so they end up as is in the config.
+func inlineSecret(secret string) bool {
+	return secret != "" && !strings.Contains(secret, "{env.") && !strings.Contains(secret, "{file.")
+}
+
+// resolveSecret replaces the {env.*} placeholders of the secret by the value
+// of the environment variable, and the {file.*} ones by the content of the
+// file, without its trailing newlines, e.g. a mounted Docker or Kubernetes
+// secret.
+func resolveSecret(secret string) (string, error) {
+	var fileErr error
+
+	repl := caddy.NewReplacer()
+	repl.Map(func(key string) (any, bool) {
+		path, ok := strings.CutPrefix(key, "file.")
+		if !ok {
+			return nil, false
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			fileErr = err
+			return nil, false
+		}
+
+		return strings.TrimRight(string(raw), "\r\n"), true
+	})
+
+	resolved := repl.ReplaceKnown(secret, "")
+	if fileErr != nil {
+		return "", fileErr
+	}
+
+	return resolved, nil
+}
+
+// checkInlineSecrets makes sure the secrets are kept out of the config when
+// `deny_inline_secrets` is set, and warns about them otherwise, as the config
+// returned by `GET /config/` on the admin API holds them.
+func (n *Ngrok) checkInlineSecrets() error {
+	var inline []string
+	if inlineSecret(n.AuthToken) {
+		inline = append(inline, "auth_token")
+	}
+
+	if tun, ok := n.tunnel.(secretsTunnel); ok {
+		inline = append(inline, tun.inlineSecrets()...)
+	}
+
+	if len(inline) == 0 {
+		return nil
+	}
+
+	if n.DenyInlineSecrets {
+		return fmt.Errorf("secrets written in the config as is: %s; refer to them with {env.*} or {file.*} placeholders instead", strings.Join(inline, ", "))
+	}
+
+	n.l.Warn("secrets written in the config as is are returned by GET /config/ on the admin API; refer to them with {env.*} or {file.*} placeholders instead",
+		zap.Strings("secrets", inline))
+
+	return nil
+}
+
+func (n *Ngrok) unmarshalDenyInlineSecrets(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	n.DenyInlineSecrets = true
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package ngroklistener
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInlineSecret(t *testing.T) {
+	require.False(t, inlineSecret(""))
+	require.False(t, inlineSecret("{env.NGROK_AUTHTOKEN}"))
+	require.False(t, inlineSecret("{file./run/secrets/ngrok}"))
+	require.True(t, inlineSecret("2abc_secret"))
+}
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("NGROK_SECRET_TEST", "from-env")
+	path := filepath.Join(t.TempDir(), "secret")
+	require.Nil(t, os.WriteFile(path, []byte("from-file\n"), 0o600))
+
+	resolved, err := resolveSecret("{env.NGROK_SECRET_TEST}")
+	require.Nil(t, err)
+	require.Equal(t, "from-env", resolved)
+
+	resolved, err = resolveSecret("{file." + path + "}")
+	require.Nil(t, err)
+	require.Equal(t, "from-file", resolved)
+
+	resolved, err = resolveSecret("as-is")
+	require.Nil(t, err)
+	require.Equal(t, "as-is", resolved)
+
+	_, err = resolveSecret("{file." + filepath.Join(t.TempDir(), "missing") + "}")
+	require.NotNil(t, err)
+}
+
+func TestDenyInlineSecrets(t *testing.T) {
+	withCountingSession(t)
+
+	t.Setenv("NGROK_SECRET_TEST", "token-secret")
+	path := filepath.Join(t.TempDir(), "secret")
+	require.Nil(t, os.WriteFile(path, []byte("basic-auth-secret\n"), 0o600))
+
+	provision := func(input string) (*Ngrok, error) {
+		n := new(Ngrok)
+		require.Nil(t, n.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)))
+
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		t.Cleanup(func() {
+			cancel()
+			require.Nil(t, n.Cleanup())
+		})
+
+		return n, n.Provision(ctx)
+	}
+
+	n, err := provision(`ngrok {
+		deny_inline_secrets
+		auth_token {env.NGROK_SECRET_TEST}
+		tunnel http {
+			basic_auth foo {file.` + path + `}
+		}
+	}`)
+	require.Nil(t, err)
+	require.True(t, n.DenyInlineSecrets)
+	require.Equal(t, "token-secret", n.AuthToken)
+	require.Equal(t, "basic-auth-secret", n.tunnel.(*HTTP).BasicAuth[0].Password)
+
+	_, err = provision(`ngrok {
+		deny_inline_secrets
+		auth_token token-secret
+		tunnel http {
+			basic_auth foo basic-auth-secret
+			oidc {
+				issuer_url https://google.com
+				client_id foo
+				client_secret oidc-secret
+			}
+			webhook_verification {
+				provider github
+				secret {env.NGROK_SECRET_TEST}
+			}
+		}
+	}`)
+	require.EqualError(t, err, "secrets written in the config as is: auth_token, basic_auth password of foo, oidc client_secret; refer to them with {env.*} or {file.*} placeholders instead")
+
+	// without deny_inline_secrets, the secrets written as is are only warned about
+	_, err = provision(`ngrok {
+		auth_token token-secret
+		tunnel http {
+			basic_auth foo basic-auth-secret
+		}
+	}`)
+	require.Nil(t, err)
+
+	require.NotNil(t, new(Ngrok).UnmarshalCaddyfile(caddyfile.NewTestDispenser(`ngrok {
+		deny_inline_secrets yes
+	}`)))
+}
@@ -0,0 +1,624 @@
+package ngroklistener
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+	ngrokZap "golang.ngrok.com/ngrok/log/zap"
+	"golang.org/x/net/proxy"
+)
+
+// sessions holds the ngrok sessions shared by all the tunnels whose
+// session-level settings are identical, keyed by sessionKey.
+var sessions = caddy.NewUsagePool()
+
+// connect establishes the ngrok session; swapped out in tests.
+var connect = ngrok.Connect
+
+// retiredSessions holds the keys of the sessions closed by a remote command;
+// see sessionKey.
+var retiredSessions sync.Map
+
+// session is a pooled ngrok session
+type session struct {
+	// current is the ngrok session, replaced when ngrok asks for a restart;
+	// mu serializes replacing and closing it
+	mu      sync.Mutex
+	current atomic.Pointer[ngrok.Session]
+
+	key    string
+	id     string
+	ctx    context.Context
+	cancel context.CancelFunc
+	opts   []ngrok.ConnectOption
+	dialer *sessionDialer
+
+	// settings are the session-level settings the session was connected
+	// with, to connect it again in another region, see relocate
+	settings *Ngrok
+
+	// gen counts the ngrok sessions connected in place of the previous one,
+	// see connectOpts
+	gen atomic.Int64
+
+	// what to do on the remote stop and restart commands
+	remoteStop    string
+	remoteRestart string
+
+	// the configured region and server, as ngrok-go does not expose the
+	// ones the session is connected to
+	region   string
+	server   string
+	metadata string
+
+	startedAt time.Time
+	connects  atomic.Int64
+
+	// the health of the session, see healthy
+	connected          atomic.Bool
+	lastHeartbeat      atomic.Int64
+	heartbeatLatency   atomic.Int64
+	heartbeatInterval  time.Duration
+	heartbeatTolerance time.Duration
+
+	events emitterRef
+	l      *zap.Logger
+}
+
+func (s *session) onConnect(context.Context, ngrok.Session) {
+	s.dialer.connected()
+	s.connected.Store(true)
+	s.lastHeartbeat.Store(time.Now().UnixNano())
+
+	ngrokMetrics.sessionConnected.WithLabelValues(s.id, s.region).Set(1)
+	if s.connects.Add(1) > 1 {
+		ngrokMetrics.sessionReconnects.WithLabelValues(s.id, s.region).Inc()
+		s.l.Info("ngrok session reconnected")
+	}
+
+	s.events.emit(eventSessionConnected, map[string]any{
+		"region": s.region,
+		"server": s.server,
+	})
+}
+
+func (s *session) onDisconnect(_ context.Context, _ ngrok.Session, err error) {
+	s.dialer.failed(err)
+	s.connected.Store(false)
+	ngrokMetrics.sessionConnected.WithLabelValues(s.id, s.region).Set(0)
+
+	switch {
+	case err == nil:
+		s.l.Info("ngrok session disconnected")
+	case s.ctx.Err() != nil:
+		// the session is being closed
+		s.l.Debug("ngrok session disconnected", zap.Error(err))
+	default:
+		if missed := s.missedHeartbeat(time.Now()); missed > 0 {
+			s.l.Warn("ngrok session heartbeat timed out",
+				zap.Duration("since_last_heartbeat", missed),
+				zap.Duration("last_latency", time.Duration(s.heartbeatLatency.Load())),
+			)
+		}
+
+		s.l.Warn("ngrok session disconnected", zap.Error(err))
+	}
+
+	s.events.emit(eventSessionDisconnected, map[string]any{
+		"region": s.region,
+		"server": s.server,
+		"error":  errString(err),
+	})
+}
+
+func (s *session) onHeartbeat(_ context.Context, _ ngrok.Session, latency time.Duration) {
+	s.lastHeartbeat.Store(time.Now().UnixNano())
+	s.heartbeatLatency.Store(int64(latency))
+
+	ngrokMetrics.heartbeatLatency.WithLabelValues(s.id, s.region).Observe(latency.Seconds())
+}
+
+// connectOpts returns the options to connect the ngrok session with, along
+// with the lifecycle handlers of the current generation of the session
+func (s *session) connectOpts() []ngrok.ConnectOption {
+	h := s.handlers()
+
+	return append(
+		slices.Clone(s.opts),
+		ngrok.WithConnectHandler(h.onConnect),
+		ngrok.WithDisconnectHandler(h.onDisconnect),
+		ngrok.WithHeartbeatHandler(h.onHeartbeat),
+	)
+}
+
+// handlers returns the lifecycle handlers of the current generation of the
+// session
+func (s *session) handlers() sessionHandlers {
+	return sessionHandlers{s: s, gen: s.gen.Load()}
+}
+
+// sessionHandlers are the lifecycle handlers of one generation of a session.
+// ngrok-go calls the handlers of a replaced ngrok session as it tears it
+// down, e.g. after a remote restart; they are ignored so that they do not
+// override the state of the ngrok session replacing it.
+type sessionHandlers struct {
+	s   *session
+	gen int64
+}
+
+// current reports whether the handlers are the ones of the current ngrok
+// session
+func (h sessionHandlers) current() bool {
+	return h.s.gen.Load() == h.gen
+}
+
+func (h sessionHandlers) onConnect(ctx context.Context, sess ngrok.Session) {
+	if h.current() {
+		h.s.onConnect(ctx, sess)
+	}
+}
+
+func (h sessionHandlers) onDisconnect(ctx context.Context, sess ngrok.Session, err error) {
+	if h.current() {
+		h.s.onDisconnect(ctx, sess, err)
+	}
+}
+
+func (h sessionHandlers) onHeartbeat(ctx context.Context, sess ngrok.Session, latency time.Duration) {
+	if h.current() {
+		h.s.onHeartbeat(ctx, sess, latency)
+	}
+}
+
+// missedHeartbeat returns how long the session has not heard from ngrok, if
+// that is longer than its heartbeat interval and tolerance.
+func (s *session) missedHeartbeat(now time.Time) time.Duration {
+	interval, tolerance := s.heartbeatInterval, s.heartbeatTolerance
+	if interval == 0 {
+		interval = defaultHeartbeatInterval
+	}
+	if tolerance == 0 {
+		tolerance = defaultHeartbeatTolerance
+	}
+
+	if since := now.Sub(time.Unix(0, s.lastHeartbeat.Load())); since > interval+tolerance {
+		return since
+	}
+
+	return 0
+}
+
+// serverOrDefault returns the ngrok server the session connects to
+func serverOrDefault(server string) string {
+	if server == "" {
+		return defaultServer
+	}
+
+	return server
+}
+
+// Listen opens a tunnel on the current ngrok session
+func (s *session) Listen(ctx context.Context, cfg config.Tunnel) (ngrok.Tunnel, error) {
+	return (*s.current.Load()).Listen(ctx, cfg)
+}
+
+// Destruct implements caddy.Destructor; it is called once the last tunnel
+// using the session is released.
+func (s *session) Destruct() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cancel()
+
+	s.l.Info("ngrok session closed")
+
+	ngrokMetrics.sessionConnected.DeleteLabelValues(s.id, s.region)
+	ngrokMetrics.sessionReconnects.DeleteLabelValues(s.id, s.region)
+	ngrokMetrics.heartbeatLatency.DeleteLabelValues(s.id, s.region)
+
+	return (*s.current.Load()).Close()
+}
+
+// sessionKey identifies the ngrok sessions that can be shared. The auth
+// token is part of the key, so the key is hashed to keep it out of memory
+// dumps and logs.
+func (n *Ngrok) sessionKey() string {
+	settings, _ := json.Marshal(struct {
+		AuthToken          string         `json:"auth_token"`
+		Region             string         `json:"region"`
+		Server             string         `json:"server"`
+		ProxyURL           string         `json:"proxy_url"`
+		HeartbeatInterval  caddy.Duration `json:"heartbeat_interval"`
+		HeartbeatTolerance caddy.Duration `json:"heartbeat_tolerance"`
+		Metadata           string         `json:"metadata"`
+		Reconnect          *Reconnect     `json:"reconnect"`
+		RemoteStop         string         `json:"remote_stop"`
+		RemoteRestart      string         `json:"remote_restart"`
+	}{
+		AuthToken:          n.AuthToken,
+		Region:             n.Region,
+		Server:             n.Server,
+		ProxyURL:           n.ProxyURL,
+		HeartbeatInterval:  n.HeartbeatInterval,
+		HeartbeatTolerance: n.HeartbeatTolerance,
+		Metadata:           n.Metadata,
+		Reconnect:          n.Reconnect,
+		RemoteStop:         n.RemoteStop,
+		RemoteRestart:      n.RemoteRestart,
+	})
+
+	sum := sha256.Sum256(settings)
+	key := hex.EncodeToString(sum[:])
+
+	// a session closed by a remote command stays in the pool until the
+	// configs using it are unloaded, so the configs loaded afterwards
+	// connect a new one under a derived key
+	for {
+		if _, retired := retiredSessions.Load(key); !retired {
+			return key
+		}
+
+		sum = sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+}
+
+// acquireSession returns the pooled session matching the settings of n,
+// connecting a new one if there is none. Every successful call must be
+// paired with a call to releaseSession.
+func (n *Ngrok) acquireSession() (*session, error) {
+	key := n.sessionKey()
+
+	val, loaded, err := sessions.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return n.connect(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sess := val.(*session)
+
+	if loaded {
+		n.l.Debug("reusing ngrok session")
+		sess.events.Store(n.events)
+	}
+
+	return sess, nil
+}
+
+// releaseSession drops a reference to the session, closing it if this was
+// the last one.
+func releaseSession(key string) error {
+	_, err := sessions.Delete(key)
+	return err
+}
+
+// connect establishes the ngrok session, giving up after the connect timeout.
+func (n *Ngrok) connect(key string) (*session, error) {
+	// the session is identified in the admin API by a prefix of its key
+	id := key[:16]
+	s := &session{
+		key:      key,
+		id:       id,
+		dialer:   &sessionDialer{proxyURL: n.proxyURL, backoff: n.Reconnect},
+		settings: n.sessionSettings(),
+		region:   n.Region,
+		server:   n.Server,
+		metadata: n.Metadata,
+
+		remoteStop:    n.RemoteStop,
+		remoteRestart: n.RemoteRestart,
+
+		heartbeatInterval:  time.Duration(n.HeartbeatInterval),
+		heartbeatTolerance: time.Duration(n.HeartbeatTolerance),
+
+		// the auth token must never be part of the logged fields
+		l: n.l.With(
+			zap.String("session_id", id),
+			zap.String("server", serverOrDefault(n.Server)),
+			zap.String("region", n.Region),
+			zap.String("metadata", n.Metadata),
+		),
+	}
+	s.dialer.l = s.l
+	s.events.Store(n.events)
+
+	s.opts = append(
+		slices.Clone(n.opts),
+		ngrok.WithLogger(ngrokZap.NewLogger(s.l)),
+		ngrok.WithDialer(s.dialer),
+		ngrok.WithStopHandler(s.onStop),
+		ngrok.WithRestartHandler(s.onRestart),
+		ngrok.WithUpdateHandler(s.onUpdate),
+	)
+
+	// the lifecycle handlers read them from ngrok-go's goroutines, which
+	// already run while the session is first connecting
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
+	s.cancel = cancel
+	s.startedAt = time.Now()
+	s.dialer.giveUp = func() {
+		s.retire()
+		cancel()
+	}
+
+	type result struct {
+		sess ngrok.Session
+		err  error
+	}
+	results := make(chan result, 1)
+
+	go func() {
+		sess, err := connect(ctx, s.connectOpts()...)
+		results <- result{sess, err}
+	}()
+
+	timer := time.NewTimer(time.Duration(n.ConnectTimeout))
+	defer timer.Stop()
+
+	var res result
+	select {
+	case res = <-results:
+	case <-timer.C:
+		cancel()
+		res = <-results
+		if res.err == nil {
+			res.sess.Close()
+		}
+		res.err = fmt.Errorf("timed out after %s: %v", time.Duration(n.ConnectTimeout), res.err)
+	}
+
+	if res.err != nil {
+		cancel()
+		return nil, res.err
+	}
+
+	s.l.Info("ngrok session connected")
+
+	s.current.Store(&res.sess)
+	s.connected.Store(true)
+	s.lastHeartbeat.CompareAndSwap(0, time.Now().UnixNano())
+	s.dialer.connected()
+
+	return s, nil
+}
+
+// reconnect makes the session reconnect to ngrok by closing its connection;
+// ngrok-go then dials a new one and restores the tunnels on it.
+func (s *session) reconnect() error {
+	return s.dialer.closeConn()
+}
+
+// relocate moves the tunnels of the session over to a session connected to
+// another region. That session is keyed as if the region were configured,
+// so it is shared with the configs loaded with that region. The session is
+// closed once its last tunnel is moved.
+//
+// The moved tunnels keep being reused across config reloads, while the
+// tunnels opened afterwards connect to the configured region again.
+func (s *session) relocate(ctx context.Context, region string) (*session, error) {
+	moved := s.settings.sessionSettings()
+	moved.Region = region
+	moved.opts = append(slices.Clone(moved.opts), ngrok.WithRegion(region))
+	moved.events = s.events.Load()
+
+	if moved.sessionKey() == s.key {
+		return s, nil
+	}
+
+	// the target session is held until the tunnels are moved, each of them
+	// acquiring its own reference to it
+	target, err := moved.acquireSession()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to region %s: %v", region, err)
+	}
+	defer releaseSession(target.key)
+
+	var errs []error
+	for _, tun := range sessionTunnels(s.key) {
+		if _, err := moved.acquireSession(); err != nil {
+			errs = append(errs, fmt.Errorf("moving tunnel %s: %v", tun.ID(), err))
+			continue
+		}
+
+		if err := tun.move(ctx, target); err != nil {
+			releaseSession(target.key)
+			errs = append(errs, fmt.Errorf("moving tunnel %s: %v", tun.ID(), err))
+			continue
+		}
+
+		s.l.Info("ngrok tunnel moved to another region",
+			zap.String("url", tun.URL()),
+			zap.String("to_session_id", target.id),
+			zap.String("to_region", region),
+		)
+		tun.events.emit(eventTunnelStarted, tun.eventData(nil))
+	}
+
+	return target, errors.Join(errs...)
+}
+
+// sessionSettings returns a config holding the session-level settings of n,
+// those sessionKey and connect are based on.
+func (n *Ngrok) sessionSettings() *Ngrok {
+	return &Ngrok{
+		AuthToken:          n.AuthToken,
+		Region:             n.Region,
+		Server:             n.Server,
+		ProxyURL:           n.ProxyURL,
+		HeartbeatInterval:  n.HeartbeatInterval,
+		HeartbeatTolerance: n.HeartbeatTolerance,
+		Metadata:           n.Metadata,
+		Reconnect:          n.Reconnect,
+		RemoteStop:         n.RemoteStop,
+		RemoteRestart:      n.RemoteRestart,
+		ConnectTimeout:     n.ConnectTimeout,
+
+		opts:     n.opts,
+		proxyURL: n.proxyURL,
+		events:   n.events,
+		l:        n.l,
+	}
+}
+
+// sessionDialer dials the connections of a session, through the proxy if
+// one is configured, like the dialer set up by ngrok.WithProxyURL would. It
+// keeps track of the latest connection so the session can be told to
+// reconnect, and waits out the reconnect backoff before each attempt.
+type sessionDialer struct {
+	proxyURL *url.URL
+	backoff  *Reconnect
+	l        *zap.Logger
+
+	// giveUp ends the session once the reconnect attempts are exhausted
+	giveUp func()
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	// established is whether the session connected once; attempts counts
+	// the reconnect attempts since it was last connected, and cause is the
+	// failure which led to the next one.
+	established bool
+	attempts    int
+	cause       error
+}
+
+func (d *sessionDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *sessionDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := d.wait(ctx); err != nil {
+		return nil, err
+	}
+
+	var dialer ngrok.Dialer = &net.Dialer{}
+
+	if d.proxyURL != nil {
+		proxied, err := proxy.FromURL(d.proxyURL, &net.Dialer{})
+		if err != nil {
+			return nil, fmt.Errorf("initializing proxy %s: %v", d.proxyURL, err)
+		}
+
+		var ok bool
+		if dialer, ok = proxied.(ngrok.Dialer); !ok {
+			return nil, fmt.Errorf("initializing proxy %s: unsupported proxy", d.proxyURL)
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		d.failed(err)
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+
+	return conn, nil
+}
+
+// wait logs the reconnect attempt about to be made and waits for its delay,
+// giving up once the attempts are exhausted. The first connection of the
+// session is dialed right away.
+func (d *sessionDialer) wait(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.established {
+		d.mu.Unlock()
+		return nil
+	}
+	d.attempts++
+	attempt, cause := d.attempts, d.cause
+	d.mu.Unlock()
+
+	if d.backoff.exhausted(attempt) {
+		d.l.Error("giving up reconnecting ngrok session",
+			zap.Int("attempts", attempt-1),
+			zap.NamedError("cause", cause),
+		)
+		d.giveUp()
+
+		return fmt.Errorf("gave up reconnecting after %d attempts: %v", attempt-1, cause)
+	}
+
+	delay := d.backoff.delay(attempt)
+
+	d.l.Warn("reconnecting ngrok session",
+		zap.Int("attempt", attempt),
+		zap.Duration("delay", delay),
+		zap.NamedError("cause", cause),
+	)
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// connected resets the reconnect attempts once the session is connected
+func (d *sessionDialer) connected() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.established = true
+	d.attempts = 0
+	d.cause = nil
+}
+
+// failed records err as the cause of the next reconnect attempt
+func (d *sessionDialer) failed(err error) {
+	if d == nil || err == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.cause = err
+}
+
+func (d *sessionDialer) closeConn() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn == nil {
+		return fmt.Errorf("session is not connected")
+	}
+
+	return d.conn.Close()
+}
+
+var (
+	_ caddy.Destructor = (*session)(nil)
+	_ ngrok.Dialer     = (*sessionDialer)(nil)
+)
@@ -0,0 +1,152 @@
+package ngroklistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.ngrok.com/ngrok"
+)
+
+func TestSessionKey(t *testing.T) {
+	base := &Ngrok{AuthToken: "foo", Region: "us"}
+
+	same := &Ngrok{AuthToken: "foo", Region: "us"}
+	require.Equal(t, base.sessionKey(), same.sessionKey())
+
+	otherToken := &Ngrok{AuthToken: "bar", Region: "us"}
+	require.NotEqual(t, base.sessionKey(), otherToken.sessionKey())
+
+	otherMetadata := &Ngrok{AuthToken: "foo", Region: "us", Metadata: "staging"}
+	require.NotEqual(t, base.sessionKey(), otherMetadata.sessionKey())
+
+	otherTunnel := &Ngrok{AuthToken: "foo", Region: "us", TunnelRaw: []byte(`{"type":"http"}`)}
+	require.Equal(t, base.sessionKey(), otherTunnel.sessionKey())
+
+	require.NotContains(t, base.sessionKey(), "foo")
+}
+
+func TestSessionPool(t *testing.T) {
+	defer func(orig func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error)) {
+		connect = orig
+	}(connect)
+
+	var connects atomic.Int32
+	var sess *fakeSession
+	connect = func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		connects.Add(1)
+		sess = newFakeSession()
+		return sess, nil
+	}
+
+	unloadFirst := provisionNgrok(t, &Ngrok{AuthToken: "pool-test"})
+	unloadSecond := provisionNgrok(t, &Ngrok{AuthToken: "pool-test", TunnelRaw: []byte(`{"type":"http"}`)})
+
+	require.EqualValues(t, 1, connects.Load())
+
+	unloadFirst()
+	require.Never(t, sess.isClosed, 50*time.Millisecond, time.Millisecond)
+
+	unloadSecond()
+	require.Eventually(t, sess.isClosed, time.Second, time.Millisecond)
+
+	provisionNgrok(t, &Ngrok{AuthToken: "pool-test"})
+	require.EqualValues(t, 2, connects.Load())
+}
+
+func TestSessionLogs(t *testing.T) {
+	withCountingSession(t)
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	n := &Ngrok{
+		AuthToken:      "session-logs-secret",
+		Region:         "eu",
+		Metadata:       "caddy",
+		ConnectTimeout: caddy.Duration(time.Second),
+		l:              zap.New(core),
+	}
+
+	s, err := n.connect(n.sessionKey())
+	require.Nil(t, err)
+	defer s.Destruct()
+
+	// ngrok-go calls the connect handler for the initial connection as well
+	s.onConnect(context.Background(), nil)
+	s.onConnect(context.Background(), nil)
+	s.lastHeartbeat.Store(time.Now().Add(-time.Minute).UnixNano())
+	s.onDisconnect(context.Background(), nil, errors.New("connection reset"))
+
+	var messages []string
+	for _, entry := range logs.All() {
+		messages = append(messages, entry.Message)
+
+		fields := entry.ContextMap()
+		require.Equal(t, s.id, fields["session_id"])
+		require.Equal(t, defaultServer, fields["server"])
+		require.Equal(t, "eu", fields["region"])
+		require.Equal(t, "caddy", fields["metadata"])
+		require.NotContains(t, fmt.Sprint(fields), n.AuthToken)
+	}
+	require.Equal(t, []string{
+		"ngrok session connected",
+		"ngrok session reconnected",
+		"ngrok session heartbeat timed out",
+		"ngrok session disconnected",
+	}, messages)
+
+	disconnected := logs.FilterMessage("ngrok session disconnected").All()[0]
+	require.Equal(t, zapcore.WarnLevel, disconnected.Level)
+	require.Equal(t, "connection reset", disconnected.ContextMap()["error"])
+}
+
+func TestSessionInitialConnectHandlers(t *testing.T) {
+	orig := connect
+	t.Cleanup(func() { connect = orig })
+	connect = ngrok.Connect
+
+	// an ngrok server hanging up on every connection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	n := &Ngrok{
+		AuthToken:      "session-initial-connect-test",
+		Server:         ln.Addr().String(),
+		ConnectTimeout: caddy.Duration(500 * time.Millisecond),
+		l:              zap.New(core),
+	}
+	require.Nil(t, n.provisionOpts())
+
+	// the disconnect handler runs while the session is first connecting, and
+	// once it is cancelled as it timed out
+	_, err = n.connect(n.sessionKey())
+	require.NotNil(t, err)
+
+	require.Eventually(t, func() bool {
+		for _, entry := range logs.FilterMessage("ngrok session disconnected").All() {
+			if entry.Level == zapcore.DebugLevel {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
@@ -17,6 +17,8 @@ func init() {
 type TCP struct {
 	opts []config.TCPEndpointOption
 
+	proxyProtoVersion config.ProxyProtoVersion
+
 	// The remote TCP address to request for this edge
 	RemoteAddr string `json:"remote_addr,omitempty"`
 
@@ -29,6 +31,10 @@ type TCP struct {
 	// Rejects connections that match the given CIDRs and allows all other CIDRs.
 	DenyCIDR []string `json:"deny_cidr,omitempty"`
 
+	// The version of the PROXY protocol, v1 or v2, whose header the ngrok edge
+	// prepends to the connections to tell the address of the client.
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+
 	l *zap.Logger
 }
 
@@ -62,6 +68,15 @@ func (t *TCP) provisionOpts() error {
 		t.opts = append(t.opts, config.WithDenyCIDRString(t.DenyCIDR...))
 	}
 
+	version, err := parseProxyProto(t.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+	if version != config.ProxyProtoNone {
+		t.proxyProtoVersion = version
+		t.opts = append(t.opts, config.WithProxyProto(version))
+	}
+
 	return nil
 }
 
@@ -69,6 +84,7 @@ func (t *TCP) doReplace() {
 	repl := caddy.NewReplacer()
 	replaceableFields := []*string{
 		&t.Metadata,
+		&t.ProxyProtocol,
 	}
 
 	for _, field := range replaceableFields {
@@ -90,6 +106,11 @@ func (t *TCP) doReplace() {
 	}
 }
 
+// proxyProto implements proxyProtoTunnel
+func (t *TCP) proxyProto() config.ProxyProtoVersion {
+	return t.proxyProtoVersion
+}
+
 // convert to ngrok's Tunnel type
 func (t *TCP) NgrokTunnel() config.Tunnel {
 	return config.TCPEndpoint(t.opts...)
@@ -134,6 +155,10 @@ func (t *TCP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 
 				t.DenyCIDR = append(t.DenyCIDR, d.RemainingArgs()...)
+			case "proxy_protocol":
+				if !d.AllArgs(&t.ProxyProtocol) {
+					return d.ArgErr()
+				}
 			default:
 				return d.Errf("unrecognized subdirective %s", subdirective)
 			}
@@ -148,4 +173,5 @@ var (
 	_ Tunnel                = (*TCP)(nil)
 	_ caddy.Provisioner     = (*TCP)(nil)
 	_ caddyfile.Unmarshaler = (*TCP)(nil)
+	_ proxyProtoTunnel      = (*TCP)(nil)
 )
@@ -254,3 +254,65 @@ func TestTCPCIDRRestrictions(t *testing.T) {
 	cases.runAll(t)
 
 }
+
+func TestTCPProxyProtocol(t *testing.T) {
+	cases := genericTestCases[*TCP]{
+		{
+			name: "v1",
+			caddyInput: `tcp {
+				proxy_protocol v1
+			}`,
+			expectConfig: func(t *testing.T, actual *TCP) {
+				require.Equal(t, "v1", actual.ProxyProtocol)
+			},
+			expectedOpts: config.TCPEndpoint(
+				config.WithProxyProto(config.ProxyProtoV1),
+			),
+		},
+		{
+			name: "v2",
+			caddyInput: `tcp {
+				proxy_protocol v2
+			}`,
+			expectConfig: func(t *testing.T, actual *TCP) {
+				require.Equal(t, "v2", actual.ProxyProtocol)
+			},
+			expectedOpts: config.TCPEndpoint(
+				config.WithProxyProto(config.ProxyProtoV2),
+			),
+		},
+		{
+			name: "absent",
+			caddyInput: `tcp {
+			}`,
+			expectConfig: func(t *testing.T, actual *TCP) {
+				require.Empty(t, actual.ProxyProtocol)
+			},
+			expectedOpts: config.TCPEndpoint(),
+		},
+		{
+			name: "unsupported-version",
+			caddyInput: `tcp {
+				proxy_protocol v3
+			}`,
+			expectConfig:       func(t *testing.T, actual *TCP) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "no-arg",
+			caddyInput: `tcp {
+				proxy_protocol
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "too-many-args",
+			caddyInput: `tcp {
+				proxy_protocol v1 v2
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+
+	cases.runAll(t)
+}
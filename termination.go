@@ -0,0 +1,331 @@
+package ngroklistener
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// The certmagic events telling that a managed certificate was obtained, or
+// loaded from the storage
+const (
+	eventCertObtained      = "cert_obtained"
+	eventCachedManagedCert = "cached_managed_cert"
+)
+
+// managedCertificate returns the PEM encoded certificate chain and private key
+// of the certificate Caddy manages for the SAN, from the `tls` app, or from the
+// storage if the `tls` app has not loaded it yet; swapped in tests
+var managedCertificate = func(ctx caddy.Context, san string) ([]byte, []byte, error) {
+	if _, err := ctx.App("tls"); err != nil {
+		return nil, nil, fmt.Errorf("loading tls app: %v", err)
+	}
+
+	var (
+		latest   *certmagic.Certificate
+		notAfter time.Time
+	)
+	for _, cert := range caddytls.AllMatchingCertificates(san) {
+		cert := cert
+		leaf, err := certificateLeaf(cert)
+		if err != nil {
+			return nil, nil, err
+		}
+		if latest == nil || leaf.NotAfter.After(notAfter) {
+			latest, notAfter = &cert, leaf.NotAfter
+		}
+	}
+
+	if latest == nil {
+		return storedCertificate(ctx, san)
+	}
+
+	var certPEM bytes.Buffer
+	for _, der := range latest.Certificate.Certificate {
+		if err := pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := x509.MarshalPKCS8PrivateKey(latest.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding private key: %v", err)
+	}
+
+	return certPEM.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), nil
+}
+
+// storedCertificate returns the certificate managed for the SAN expiring last
+// among the ones the issuers stored in the Caddy storage
+func storedCertificate(ctx caddy.Context, san string) ([]byte, []byte, error) {
+	stor := storage(ctx)
+
+	// nothing is stored until the tls app obtains its first certificate
+	issuers, err := stor.List(ctx, certmagic.StorageKeys.CertsPrefix(""), false)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("listing certificate issuers: %v", err)
+	}
+
+	var certPEM, keyPEM []byte
+	var notAfter int64
+	for _, issuer := range issuers {
+		issuerKey := path.Base(issuer)
+
+		cert, err := stor.Load(ctx, certmagic.StorageKeys.SiteCert(issuerKey, san))
+		if err != nil {
+			continue
+		}
+		key, err := stor.Load(ctx, certmagic.StorageKeys.SitePrivateKey(issuerKey, san))
+		if err != nil {
+			continue
+		}
+
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			continue
+		}
+
+		if leaf.NotAfter.Unix() > notAfter {
+			certPEM, keyPEM, notAfter = cert, key, leaf.NotAfter.Unix()
+		}
+	}
+
+	if certPEM == nil {
+		return nil, nil, fmt.Errorf("no certificate managed for %s", san)
+	}
+
+	return certPEM, keyPEM, nil
+}
+
+// subscribeCertificateEvents makes the handler be notified of the managed
+// certificates obtained or loaded by the `tls` app; swapped in tests
+var subscribeCertificateEvents = func(ctx caddy.Context, handler caddyevents.Handler) error {
+	app, err := ctx.App("events")
+	if err != nil {
+		return fmt.Errorf("loading events app: %v", err)
+	}
+
+	events := app.(*caddyevents.App)
+	if err := events.On(eventCertObtained, handler); err != nil {
+		return err
+	}
+
+	return events.On(eventCachedManagedCert, handler)
+}
+
+// tlsTermination makes the ngrok edge terminate TLS with the certificate and
+// key, either read from files or managed by Caddy
+type tlsTermination struct {
+	mu      sync.Mutex
+	certPEM []byte
+	keyPEM  []byte
+	renewed func()
+
+	ctx caddy.Context
+	l   *zap.Logger
+
+	// The path of the PEM encoded certificate chain
+	CertFile string `json:"cert_file,omitempty"`
+
+	// The path of the PEM encoded private key
+	KeyFile string `json:"key_file,omitempty"`
+
+	// The name of a certificate managed by the Caddy `tls` app, typically the
+	// domain of the tunnel. The certificate is sent to ngrok again whenever
+	// Caddy renews it. Until the `tls` app first obtains it, e.g. on a fresh
+	// deployment, the tunnel is opened without termination, passing TLS
+	// through to Caddy.
+	TLSCertificate string `json:"tls_certificate,omitempty"`
+}
+
+func (tt *tlsTermination) Provision(ctx caddy.Context) error {
+	tt.ctx = ctx
+	tt.l = ctx.Logger()
+
+	tt.doReplace()
+
+	var (
+		certPEM, keyPEM []byte
+		err             error
+	)
+	switch {
+	case tt.TLSCertificate != "" && (tt.CertFile != "" || tt.KeyFile != ""):
+		return errors.New("termination `tls_certificate` cannot be used along with `cert_file` and `key_file`")
+	case tt.TLSCertificate != "":
+		if err := subscribeCertificateEvents(ctx, tt); err != nil {
+			return fmt.Errorf("subscribing to certificate events: %v", err)
+		}
+
+		// the tls app only obtains the certificates once started, after the
+		// config is provisioned; the certificate is loaded once it is
+		certPEM, keyPEM, err = managedCertificate(ctx, tt.TLSCertificate)
+		if err != nil {
+			tt.l.Warn("ngrok termination certificate not obtained yet, passing TLS through until it is",
+				zap.String("tls_certificate", tt.TLSCertificate), zap.Error(err))
+			return nil
+		}
+	case tt.CertFile != "" && tt.KeyFile != "":
+		if certPEM, err = os.ReadFile(tt.CertFile); err != nil {
+			return fmt.Errorf("reading termination cert_file: %v", err)
+		}
+		if keyPEM, err = os.ReadFile(tt.KeyFile); err != nil {
+			return fmt.Errorf("reading termination key_file: %v", err)
+		}
+	default:
+		return errors.New("termination requires both `cert_file` and `key_file`, or `tls_certificate`")
+	}
+
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return fmt.Errorf("parsing termination certificate: %v", err)
+	}
+
+	tt.mu.Lock()
+	tt.certPEM, tt.keyPEM = certPEM, keyPEM
+	tt.mu.Unlock()
+
+	return nil
+}
+
+func (tt *tlsTermination) doReplace() {
+	repl := caddy.NewReplacer()
+
+	tt.CertFile = repl.ReplaceKnown(tt.CertFile, "")
+	tt.KeyFile = repl.ReplaceKnown(tt.KeyFile, "")
+	tt.TLSCertificate = repl.ReplaceKnown(tt.TLSCertificate, "")
+}
+
+// pair returns the PEM encoded certificate chain and private key, which are
+// nil while the managed certificate has not been obtained yet
+func (tt *tlsTermination) pair() ([]byte, []byte) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	return tt.certPEM, tt.keyPEM
+}
+
+// onRenew sets the function called once the certificate is renewed
+func (tt *tlsTermination) onRenew(renewed func()) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tt.renewed = renewed
+}
+
+// fingerprint returns the SHA-256 fingerprint of the certificate and key read
+// from files, which are not part of the definition of the tunnel
+func (tt *tlsTermination) fingerprint() string {
+	if tt.TLSCertificate != "" {
+		return ""
+	}
+
+	certPEM, keyPEM := tt.pair()
+	sum := sha256.Sum256(append(slices.Clone(certPEM), keyPEM...))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Handle implements caddyevents.Handler, loading the managed certificate
+// again when the `tls` app obtains or loads a certificate for its name.
+func (tt *tlsTermination) Handle(_ context.Context, e caddyevents.Event) error {
+	concerned := e.Data["identifier"] == tt.TLSCertificate
+	if sans, ok := e.Data["sans"].([]string); ok {
+		concerned = concerned || slices.Contains(sans, tt.TLSCertificate)
+	}
+
+	if concerned {
+		go tt.reload()
+	}
+
+	return nil
+}
+
+// reload loads the managed certificate, and calls the renewal function if
+// it changed, e.g. as it was renewed or obtained for the first time
+func (tt *tlsTermination) reload() {
+	certPEM, keyPEM, err := managedCertificate(tt.ctx, tt.TLSCertificate)
+	if err != nil {
+		tt.l.Error("loading renewed ngrok termination certificate", zap.Error(err))
+		return
+	}
+
+	tt.mu.Lock()
+	if bytes.Equal(certPEM, tt.certPEM) && bytes.Equal(keyPEM, tt.keyPEM) {
+		tt.mu.Unlock()
+		return
+	}
+	tt.certPEM, tt.keyPEM = certPEM, keyPEM
+	renewed := tt.renewed
+	tt.mu.Unlock()
+
+	tt.l.Info("ngrok termination certificate loaded", zap.String("tls_certificate", tt.TLSCertificate))
+
+	if renewed != nil {
+		renewed()
+	}
+}
+
+func (tt *tlsTermination) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if d.NextArg() { // the certificate and key files are given inline
+		tt.CertFile = d.Val()
+		if !d.AllArgs(&tt.KeyFile) {
+			return d.ArgErr()
+		}
+
+		if d.NextBlock(d.Nesting()) {
+			return d.Err("cannot specify termination in both arguments and block")
+		}
+
+		return nil
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		subdirective := d.Val()
+		switch subdirective {
+		case "cert_file":
+			if !d.AllArgs(&tt.CertFile) {
+				return d.ArgErr()
+			}
+		case "key_file":
+			if !d.AllArgs(&tt.KeyFile) {
+				return d.ArgErr()
+			}
+		case "tls_certificate":
+			if !d.AllArgs(&tt.TLSCertificate) {
+				return d.ArgErr()
+			}
+		default:
+			return d.Errf("unrecognized subdirective %s", subdirective)
+		}
+	}
+
+	if tt.TLSCertificate == "" && (tt.CertFile == "" || tt.KeyFile == "") {
+		return d.Err("termination requires both cert_file and key_file, or tls_certificate")
+	}
+
+	return nil
+}
+
+var _ caddyevents.Handler = (*tlsTermination)(nil)
@@ -0,0 +1,343 @@
+package ngroklistener
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	_ "github.com/caddyserver/caddy/v2/modules/filestorage"
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok/config"
+)
+
+// testManagedCertificates stands for the certificates managed by the Caddy
+// tls app, and the handlers notified of their renewal
+type testManagedCertificates struct {
+	mu       sync.Mutex
+	pairs    map[string][2]string
+	handlers []caddyevents.Handler
+	loads    atomic.Int32
+}
+
+func (m *testManagedCertificates) set(san, certPEM, keyPEM string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pairs[san] = [2]string{certPEM, keyPEM}
+}
+
+// renew notifies the handlers that the certificate of the SAN was obtained
+func (m *testManagedCertificates) renew(t *testing.T, san string) {
+	m.mu.Lock()
+	handlers := m.handlers
+	m.mu.Unlock()
+
+	for _, handler := range handlers {
+		require.Nil(t, handler.Handle(context.Background(), caddyevents.Event{
+			Data: map[string]any{"identifier": san},
+		}))
+	}
+}
+
+// withManagedCertificates makes the certificates managed by the Caddy tls
+// app, and their renewal, be faked
+func withManagedCertificates(t *testing.T) *testManagedCertificates {
+	origCertificate, origSubscribe := managedCertificate, subscribeCertificateEvents
+	t.Cleanup(func() { managedCertificate, subscribeCertificateEvents = origCertificate, origSubscribe })
+
+	m := &testManagedCertificates{pairs: map[string][2]string{}}
+	managedCertificate = func(_ caddy.Context, san string) ([]byte, []byte, error) {
+		m.loads.Add(1)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		pair, ok := m.pairs[san]
+		if !ok {
+			return nil, nil, os.ErrNotExist
+		}
+		return []byte(pair[0]), []byte(pair[1]), nil
+	}
+	subscribeCertificateEvents = func(_ caddy.Context, handler caddyevents.Handler) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.handlers = append(m.handlers, handler)
+		return nil
+	}
+
+	return m
+}
+
+func TestTLSTermination(t *testing.T) {
+	_, certPEM, keyPEM := newTestCert(t, testCert{name: "foo.example", sans: []string{"foo.example"}})
+	_, _, otherKeyPEM := newTestCert(t, testCert{name: "other.example", sans: []string{"other.example"}})
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+	certFile := write("cert.pem", certPEM)
+	keyFile := write("key.pem", keyPEM)
+	otherKeyFile := write("other-key.pem", otherKeyPEM)
+
+	managed := withManagedCertificates(t)
+	managed.set("foo.example", certPEM, keyPEM)
+
+	cases := genericTestCases[*TLS]{
+		{
+			name: "inline",
+			caddyInput: `tls {
+				termination ` + certFile + ` ` + keyFile + `
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.Equal(t, certFile, actual.Termination.CertFile)
+				require.Equal(t, keyFile, actual.Termination.KeyFile)
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithTermination([]byte(certPEM), []byte(keyPEM)),
+			),
+		},
+		{
+			name: "files",
+			caddyInput: `tls {
+				termination {
+					cert_file ` + certFile + `
+					key_file ` + keyFile + `
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.Equal(t, certFile, actual.Termination.CertFile)
+				require.Equal(t, keyFile, actual.Termination.KeyFile)
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithTermination([]byte(certPEM), []byte(keyPEM)),
+			),
+		},
+		{
+			name: "tls_certificate",
+			caddyInput: `tls {
+				domain foo.example
+				termination {
+					tls_certificate foo.example
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.Equal(t, "foo.example", actual.Termination.TLSCertificate)
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithDomain("foo.example"),
+				config.WithTermination([]byte(certPEM), []byte(keyPEM)),
+			),
+		},
+		{
+			name: "inline-missing-key",
+			caddyInput: `tls {
+				termination ` + certFile + `
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "inline-and-block",
+			caddyInput: `tls {
+				termination ` + certFile + ` ` + keyFile + ` {
+					tls_certificate foo.example
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "missing-key_file",
+			caddyInput: `tls {
+				termination {
+					cert_file ` + certFile + `
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "unrecognized-subdirective",
+			caddyInput: `tls {
+				termination {
+					foo bar
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "files-and-tls_certificate",
+			caddyInput: `tls {
+				termination {
+					cert_file ` + certFile + `
+					key_file ` + keyFile + `
+					tls_certificate foo.example
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *TLS) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "cert_file-missing",
+			caddyInput: `tls {
+				termination ` + filepath.Join(dir, "missing.pem") + ` ` + keyFile + `
+			}`,
+			expectConfig:       func(t *testing.T, actual *TLS) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "mismatched-key",
+			caddyInput: `tls {
+				termination ` + certFile + ` ` + otherKeyFile + `
+			}`,
+			expectConfig:       func(t *testing.T, actual *TLS) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "tls_certificate-not-obtained",
+			caddyInput: `tls {
+				termination {
+					tls_certificate unknown.example
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.Equal(t, "unknown.example", actual.Termination.TLSCertificate)
+			},
+			expectedOpts: config.TLSEndpoint(),
+		},
+	}
+
+	cases.runAll(t)
+}
+
+func TestTLSTerminationRenewal(t *testing.T) {
+	sess := withCountingSession(t)
+	managed := withManagedCertificates(t)
+
+	_, certPEM, keyPEM := newTestCert(t, testCert{name: "foo.example", sans: []string{"foo.example"}})
+	managed.set("foo.example", certPEM, keyPEM)
+
+	n := &Ngrok{
+		AuthToken: "termination-renewal-test",
+		TunnelRaw: []byte(`{"type":"tls","termination":{"tls_certificate":"foo.example"}}`),
+	}
+	provisionNgrok(t, n)
+	require.EqualValues(t, 1, sess.listens.Load())
+
+	// another certificate being obtained does not restart the tunnel
+	managed.renew(t, "bar.example")
+
+	// the certificate is renewed
+	_, renewedCertPEM, renewedKeyPEM := newTestCert(t, testCert{name: "foo.example", sans: []string{"foo.example"}})
+	managed.set("foo.example", renewedCertPEM, renewedKeyPEM)
+	managed.renew(t, "foo.example")
+
+	require.Eventually(t, func() bool { return sess.listens.Load() == 2 }, time.Second, 10*time.Millisecond)
+
+	expected := config.TLSEndpoint(config.WithTermination([]byte(renewedCertPEM), []byte(renewedKeyPEM)))
+	require.Equal(t, expected, n.tunnel.NgrokTunnel())
+	n.shared.mu.Lock()
+	require.Equal(t, expected, n.shared.cfg)
+	n.shared.mu.Unlock()
+
+	// the certificate being loaded again unchanged does not restart the tunnel
+	loads := managed.loads.Load()
+	managed.renew(t, "foo.example")
+	require.Eventually(t, func() bool { return managed.loads.Load() > loads }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.EqualValues(t, 2, sess.listens.Load())
+}
+
+func TestTLSTerminationObtained(t *testing.T) {
+	sess := withCountingSession(t)
+	managed := withManagedCertificates(t)
+
+	// the tls app obtains the certificate once the config is provisioned
+	n := &Ngrok{
+		AuthToken: "termination-obtained-test",
+		TunnelRaw: []byte(`{"type":"tls","termination":{"tls_certificate":"foo.example"}}`),
+	}
+	provisionNgrok(t, n)
+	require.EqualValues(t, 1, sess.listens.Load())
+	require.Equal(t, config.TLSEndpoint(), n.tunnel.NgrokTunnel())
+
+	_, certPEM, keyPEM := newTestCert(t, testCert{name: "foo.example", sans: []string{"foo.example"}})
+	managed.set("foo.example", certPEM, keyPEM)
+	managed.renew(t, "foo.example")
+
+	require.Eventually(t, func() bool { return sess.listens.Load() == 2 }, time.Second, 10*time.Millisecond)
+
+	expected := config.TLSEndpoint(config.WithTermination([]byte(certPEM), []byte(keyPEM)))
+	n.shared.mu.Lock()
+	require.Equal(t, expected, n.shared.cfg)
+	n.shared.mu.Unlock()
+}
+
+func TestTLSTerminationStoredCertificate(t *testing.T) {
+	sess := withCountingSession(t)
+
+	// the events are emitted on behalf of a module, as the tls app does
+	var moduleCtx caddy.Context
+	orig := subscribeCertificateEvents
+	t.Cleanup(func() { subscribeCertificateEvents = orig })
+	subscribeCertificateEvents = func(ctx caddy.Context, handler caddyevents.Handler) error {
+		moduleCtx = ctx
+		return orig(ctx, handler)
+	}
+
+	// a fresh deployment: the tls app has not obtained the certificate yet
+	dir := t.TempDir()
+	stor := &certmagic.FileStorage{Path: dir}
+
+	cfg := []byte(`{
+		"admin": {"disabled": true},
+		"storage": {"module": "file_system", "root": "` + dir + `"},
+		"apps": {
+			"events": {},
+			"tls": {},
+			"http": {
+				"servers": {
+					"ngrok": {
+						"listen": ["127.0.0.1:0"],
+						"listener_wrappers": [{
+							"wrapper": "ngrok",
+							"auth_token": "termination-stored-test",
+							"tunnel": {"type": "tls", "termination": {"tls_certificate": "foo.example"}}
+						}],
+						"automatic_https": {"disable": true}
+					}
+				}
+			}
+		}
+	}`)
+	require.Nil(t, caddy.Load(cfg, true))
+	t.Cleanup(func() { require.Nil(t, caddy.Stop()) })
+
+	ctx := caddy.ActiveContext()
+	_, _, err := storedCertificate(ctx, "foo.example")
+	require.EqualError(t, err, "no certificate managed for foo.example")
+
+	// the tunnel passes TLS through meanwhile
+	require.EqualValues(t, 1, sess.listens.Load())
+	require.Equal(t, config.TLSEndpoint(), sess.lastCfg.Load())
+
+	// the tls app obtains the certificate
+	_, certPEM, keyPEM := newTestCert(t, testCert{name: "foo.example", sans: []string{"foo.example"}})
+	issuer := "acme-v02.api.letsencrypt.org-directory"
+	require.Nil(t, stor.Store(ctx, certmagic.StorageKeys.SiteCert(issuer, "foo.example"), []byte(certPEM)))
+	require.Nil(t, stor.Store(ctx, certmagic.StorageKeys.SitePrivateKey(issuer, "foo.example"), []byte(keyPEM)))
+
+	events, err := ctx.App("events")
+	require.Nil(t, err)
+	events.(*caddyevents.App).Emit(moduleCtx, eventCertObtained, map[string]any{"identifier": "foo.example"})
+
+	require.Eventually(t, func() bool { return sess.listens.Load() == 2 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, config.TLSEndpoint(config.WithTermination([]byte(certPEM), []byte(keyPEM))), sess.lastCfg.Load())
+}
@@ -2,6 +2,7 @@ package ngroklistener
 
 import (
 	"fmt"
+	"slices"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -18,6 +19,8 @@ func init() {
 type TLS struct {
 	opts []config.TLSEndpointOption
 
+	proxyProtoVersion config.ProxyProtoVersion
+
 	// the domain for this edge.
 	Domain string `json:"domain,omitempty"`
 
@@ -30,6 +33,17 @@ type TLS struct {
 	// Rejects connections that match the given CIDRs and allows all other CIDRs.
 	DenyCIDR []string `json:"deny_cidr,omitempty"`
 
+	// The version of the PROXY protocol, v1 or v2, whose header the ngrok edge
+	// prepends to the connections to tell the address of the client.
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+
+	// Requires the clients to present a certificate signed by one of the CAs.
+	MutualTLS *mutualTLS `json:"mutual_tls,omitempty"`
+
+	// Terminates TLS at the ngrok edge with the given certificate, instead of
+	// passing it through to Caddy.
+	Termination *tlsTermination `json:"termination,omitempty"`
+
 	l *zap.Logger
 }
 
@@ -53,6 +67,20 @@ func (t *TLS) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("provisioning tls tunnel opts: %v", err)
 	}
 
+	if t.MutualTLS != nil {
+		err := t.MutualTLS.Provision(ctx)
+		if err != nil {
+			return fmt.Errorf("provisioning mutual_tls: %v", err)
+		}
+		t.opts = append(t.opts, config.WithMutualTLSCA(t.MutualTLS.certs...))
+	}
+
+	if t.Termination != nil {
+		if err := t.Termination.Provision(ctx); err != nil {
+			return fmt.Errorf("provisioning termination: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -73,6 +101,15 @@ func (t *TLS) provisionOpts() error {
 		t.opts = append(t.opts, config.WithDenyCIDRString(t.DenyCIDR...))
 	}
 
+	version, err := parseProxyProto(t.ProxyProtocol)
+	if err != nil {
+		return err
+	}
+	if version != config.ProxyProtoNone {
+		t.proxyProtoVersion = version
+		t.opts = append(t.opts, config.WithProxyProto(version))
+	}
+
 	return nil
 }
 
@@ -80,6 +117,7 @@ func (t *TLS) doReplace() {
 	repl := caddy.NewReplacer()
 	replaceableFields := []*string{
 		&t.Metadata,
+		&t.ProxyProtocol,
 		&t.Domain,
 	}
 
@@ -102,9 +140,47 @@ func (t *TLS) doReplace() {
 	}
 }
 
+// proxyProto implements proxyProtoTunnel
+func (t *TLS) proxyProto() config.ProxyProtoVersion {
+	return t.proxyProtoVersion
+}
+
 // convert to ngrok's Tunnel type
 func (t *TLS) NgrokTunnel() config.Tunnel {
-	return config.TLSEndpoint(t.opts...)
+	if t.Termination == nil {
+		return config.TLSEndpoint(t.opts...)
+	}
+
+	// the certificate changes when it is renewed, and is missing until the
+	// managed certificate is obtained
+	certPEM, keyPEM := t.Termination.pair()
+	if certPEM == nil {
+		return config.TLSEndpoint(t.opts...)
+	}
+
+	return config.TLSEndpoint(append(slices.Clone(t.opts), config.WithTermination(certPEM, keyPEM))...)
+}
+
+// keyMaterial implements keyedTunnel, as the mutual_tls CA certificates and
+// the termination certificate are not part of the definition of the tunnel
+func (t *TLS) keyMaterial() []string {
+	var material []string
+	if t.MutualTLS != nil {
+		material = append(material, t.MutualTLS.fingerprints()...)
+	}
+
+	if t.Termination != nil {
+		material = append(material, t.Termination.fingerprint())
+	}
+
+	return material
+}
+
+// onRenew implements renewableTunnel
+func (t *TLS) onRenew(renewed func()) {
+	if t.Termination != nil {
+		t.Termination.onRenew(renewed)
+	}
 }
 
 func (t *TLS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -132,6 +208,18 @@ func (t *TLS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if err := t.unmarshalDenyCidr(d); err != nil {
 					return err
 				}
+			case "mutual_tls":
+				if err := t.unmarshalMutualTLS(d); err != nil {
+					return err
+				}
+			case "termination":
+				if err := t.unmarshalTermination(d); err != nil {
+					return err
+				}
+			case "proxy_protocol":
+				if !d.AllArgs(&t.ProxyProtocol) {
+					return d.ArgErr()
+				}
 			default:
 				return d.Errf("unrecognized subdirective %s", subdirective)
 			}
@@ -161,9 +249,36 @@ func (t *TLS) unmarshalDenyCidr(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+func (t *TLS) unmarshalMutualTLS(d *caddyfile.Dispenser) error {
+	mutualTLS := mutualTLS{}
+	err := mutualTLS.UnmarshalCaddyfile(d)
+	if err != nil {
+		return d.Errf(`parsing mutual_tls %w`, err)
+	}
+
+	t.MutualTLS = &mutualTLS
+
+	return nil
+}
+
+func (t *TLS) unmarshalTermination(d *caddyfile.Dispenser) error {
+	termination := tlsTermination{}
+	err := termination.UnmarshalCaddyfile(d)
+	if err != nil {
+		return d.Errf(`parsing termination %w`, err)
+	}
+
+	t.Termination = &termination
+
+	return nil
+}
+
 var (
 	_ caddy.Module          = (*TLS)(nil)
 	_ Tunnel                = (*TLS)(nil)
 	_ caddy.Provisioner     = (*TLS)(nil)
 	_ caddyfile.Unmarshaler = (*TLS)(nil)
+	_ proxyProtoTunnel      = (*TLS)(nil)
+	_ keyedTunnel           = (*TLS)(nil)
+	_ renewableTunnel       = (*TLS)(nil)
 )
@@ -1,7 +1,11 @@
 package ngroklistener
 
 import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"golang.ngrok.com/ngrok/config"
@@ -263,3 +267,219 @@ func TestTLSCIDRRestrictions(t *testing.T) {
 	cases.runAll(t)
 
 }
+
+func TestTLSMutualTLS(t *testing.T) {
+	now := time.Now()
+	ca, caPEM, _ := newTestCert(t, testCert{name: "ca", ca: true})
+	other, otherPEM, _ := newTestCert(t, testCert{name: "other", ca: true})
+	_, expiredPEM, _ := newTestCert(t, testCert{name: "expired", ca: true, notBefore: now.Add(-2 * time.Hour), notAfter: now.Add(-time.Hour)})
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+	caFile := write("ca.pem", caPEM)
+	otherFile := write("other.pem", otherPEM)
+	expiredFile := write("expired.pem", expiredPEM)
+
+	withTLSCertificates(t, map[string][]*x509.Certificate{"ca.internal": {other}})
+
+	cases := genericTestCases[*TLS]{
+		{
+			name: "absent",
+			caddyInput: `tls {
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.Nil(t, actual.MutualTLS)
+			},
+			expectedOpts: config.TLSEndpoint(),
+		},
+		{
+			name: "ca_file",
+			caddyInput: `tls {
+				mutual_tls {
+					ca_file ` + caFile + `
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.ElementsMatch(t, actual.MutualTLS.CAFiles, []string{caFile})
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithMutualTLSCA(ca),
+			),
+		},
+		{
+			name: "ca_file multi",
+			caddyInput: `tls {
+				mutual_tls {
+					ca_file ` + caFile + `
+					ca_file ` + otherFile + `
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.ElementsMatch(t, actual.MutualTLS.CAFiles, []string{caFile, otherFile})
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithMutualTLSCA(ca, other),
+			),
+		},
+		{
+			name: "ca_file multi inline",
+			caddyInput: `tls {
+				mutual_tls {
+					ca_file ` + caFile + ` ` + otherFile + `
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.ElementsMatch(t, actual.MutualTLS.CAFiles, []string{caFile, otherFile})
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithMutualTLSCA(ca, other),
+			),
+		},
+		{
+			name:       "ca_pem",
+			caddyInput: "tls {\n\tmutual_tls {\n\t\tca_pem `" + caPEM + "`\n\t}\n}",
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.ElementsMatch(t, actual.MutualTLS.CAPEM, []string{caPEM})
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithMutualTLSCA(ca),
+			),
+		},
+		{
+			name: "tls_certificate",
+			caddyInput: `tls {
+				mutual_tls {
+					tls_certificate ca.internal
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.ElementsMatch(t, actual.MutualTLS.TLSCertificates, []string{"ca.internal"})
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithMutualTLSCA(other),
+			),
+		},
+		{
+			name: "mutual_tls and cidr",
+			caddyInput: `tls {
+				allow 127.0.0.0/8
+				mutual_tls {
+					ca_file ` + caFile + `
+				}
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.ElementsMatch(t, actual.AllowCIDR, []string{"127.0.0.0/8"})
+				require.ElementsMatch(t, actual.MutualTLS.CAFiles, []string{caFile})
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithAllowCIDRString("127.0.0.0/8"),
+				config.WithMutualTLSCA(ca),
+			),
+		},
+		{
+			name: "mutual_tls-empty",
+			caddyInput: `tls {
+				mutual_tls {
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "ca_file-no-args",
+			caddyInput: `tls {
+				mutual_tls {
+					ca_file
+				}
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "ca_file-missing",
+			caddyInput: `tls {
+				mutual_tls {
+					ca_file ` + filepath.Join(dir, "missing.pem") + `
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *TLS) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "expired",
+			caddyInput: `tls {
+				mutual_tls {
+					ca_file ` + expiredFile + `
+				}
+			}`,
+			expectConfig:       func(t *testing.T, actual *TLS) {},
+			expectProvisionErr: true,
+		},
+	}
+
+	cases.runAll(t)
+}
+
+func TestTLSProxyProtocol(t *testing.T) {
+	cases := genericTestCases[*TLS]{
+		{
+			name: "v1",
+			caddyInput: `tls {
+				proxy_protocol v1
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.Equal(t, "v1", actual.ProxyProtocol)
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithProxyProto(config.ProxyProtoV1),
+			),
+		},
+		{
+			name: "v2",
+			caddyInput: `tls {
+				proxy_protocol v2
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.Equal(t, "v2", actual.ProxyProtocol)
+			},
+			expectedOpts: config.TLSEndpoint(
+				config.WithProxyProto(config.ProxyProtoV2),
+			),
+		},
+		{
+			name: "absent",
+			caddyInput: `tls {
+			}`,
+			expectConfig: func(t *testing.T, actual *TLS) {
+				require.Empty(t, actual.ProxyProtocol)
+			},
+			expectedOpts: config.TLSEndpoint(),
+		},
+		{
+			name: "unsupported-version",
+			caddyInput: `tls {
+				proxy_protocol v3
+			}`,
+			expectConfig:       func(t *testing.T, actual *TLS) {},
+			expectProvisionErr: true,
+		},
+		{
+			name: "no-arg",
+			caddyInput: `tls {
+				proxy_protocol
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "too-many-args",
+			caddyInput: `tls {
+				proxy_protocol v1 v2
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+
+	cases.runAll(t)
+}
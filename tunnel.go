@@ -0,0 +1,676 @@
+package ngroklistener
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+)
+
+// tunnels holds the open ngrok tunnels keyed by tunnelKey. A tunnel stays
+// open across config reloads for as long as a config defining the same
+// tunnel on the same session is loaded.
+var tunnels = caddy.NewUsagePool()
+
+// retiredTunnels holds the keys of the tunnels closed through the admin API
+// or by a remote command; see tunnelKey.
+var retiredTunnels sync.Map
+
+// sharedTunnel is a pooled ngrok tunnel. Its connections are accepted once
+// and handed out to whichever listener returned by WrapListener asks first.
+type sharedTunnel struct {
+	*restartableTunnel
+
+	key       string
+	startedAt time.Time
+
+	// the session and definition the tunnel is opened with, to restart it;
+	// the session changes once the tunnel is moved to another one, see move
+	sess atomic.Pointer[session]
+	cfg  config.Tunnel
+
+	// kind is the type of the tunnel: http, tcp, tls or labeled
+	kind string
+
+	// seriesURL is the URL labeling the metrics of the tunnel, see
+	// useTunnelSeries; it is guarded by mu
+	seriesURL string
+
+	// drainTimeout bounds how long Destruct waits for the accepted
+	// connections to be closed; it follows the latest config using the tunnel.
+	drainTimeout atomic.Int64
+	active       sync.WaitGroup
+
+	acceptedConns atomic.Int64
+	activeConns   atomic.Int64
+
+	// mu serializes restarting and closing the tunnel
+	mu      sync.Mutex
+	conns   chan net.Conn
+	closing chan struct{}
+
+	stopped   chan struct{}
+	acceptErr error
+
+	// holders are the configs using the tunnel, whose url_file is written
+	// again once the tunnel is replaced
+	holdersMu sync.Mutex
+	holders   map[*Ngrok]struct{}
+
+	events emitterRef
+	l      *zap.Logger
+}
+
+func newSharedTunnel(tun ngrok.Tunnel, key string, sess *session, l *zap.Logger) *sharedTunnel {
+	t := &sharedTunnel{
+		restartableTunnel: newRestartableTunnel(tun),
+		key:               key,
+		startedAt:         time.Now(),
+		conns:             make(chan net.Conn),
+		closing:           make(chan struct{}),
+		stopped:           make(chan struct{}),
+		holders:           make(map[*Ngrok]struct{}),
+		l:                 l,
+	}
+	t.sess.Store(sess)
+
+	go t.acceptLoop()
+
+	return t
+}
+
+func (t *sharedTunnel) acceptLoop() {
+	defer close(t.stopped)
+
+	for {
+		conn, err := t.restartableTunnel.Accept()
+		if err != nil {
+			t.acceptErr = err
+			return
+		}
+
+		t.active.Add(1)
+		t.acceptedConns.Add(1)
+		t.activeConns.Add(1)
+		conn = &tunnelConn{Conn: conn, tunnel: t, metrics: newConnMetrics(t)}
+
+		select {
+		case t.conns <- conn:
+		case <-t.closing:
+			conn.Close()
+			t.acceptErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+// listener returns a net.Listener accepting connections from the tunnel.
+// Closing it leaves the tunnel open.
+func (t *sharedTunnel) listener() net.Listener {
+	return &tunnelView{tunnel: t, done: make(chan struct{})}
+}
+
+// Destruct implements caddy.Destructor; it is called once the last config
+// using the tunnel is unloaded. The tunnel stops accepting connections right
+// away, while the session is held until the accepted connections are closed
+// or the drain timeout elapses.
+func (t *sharedTunnel) Destruct() error {
+	closed, err := t.close()
+
+	if !t.drain(time.Duration(t.drainTimeout.Load())) {
+		t.l.Warn("ngrok tunnel connections still open after drain timeout",
+			zap.String("url", t.URL()),
+			zap.Duration("drain_timeout", time.Duration(t.drainTimeout.Load())),
+		)
+	}
+
+	releaseSession(t.session().key)
+
+	t.mu.Lock()
+	releaseTunnelSeries(t.kind, t.seriesURL)
+	t.mu.Unlock()
+
+	t.l.Info("ngrok tunnel released", zap.String("url", t.URL()), zap.String("id", t.ID()))
+	if closed {
+		t.events.emit(eventTunnelClosed, t.eventData(err))
+	}
+
+	return err
+}
+
+// close closes the ngrok tunnel, leaving the accepted connections open. It
+// reports whether the tunnel was closed by this call.
+func (t *sharedTunnel) close() (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case <-t.closing:
+		return false, nil
+	default:
+	}
+
+	close(t.closing)
+	err := t.restartableTunnel.Close()
+	t.endReplace()
+	<-t.stopped
+
+	return true, err
+}
+
+// closed reports whether the tunnel was closed
+func (t *sharedTunnel) closed() bool {
+	select {
+	case <-t.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// retire closes the tunnel ahead of the configs using it being unloaded, e.g.
+// through the admin API, keeping the configs loaded from now on from reusing
+// it. It reports whether the tunnel was closed by this call.
+func (t *sharedTunnel) retire() (bool, error) {
+	retiredTunnels.Store(t.key, struct{}{})
+
+	return t.close()
+}
+
+// session returns the session the tunnel is opened on
+func (t *sharedTunnel) session() *session {
+	return t.sess.Load()
+}
+
+// restart replaces the ngrok tunnel by a new one with the same definition on
+// the same session. The listeners keep accepting connections, from the new
+// tunnel once it is up.
+func (t *sharedTunnel) restart(ctx context.Context) error {
+	_, err := t.reopen(ctx, nil, nil)
+	return err
+}
+
+// redefine replaces the ngrok tunnel like restart does, by a new one with the
+// given definition, or the same one if cfg is nil
+func (t *sharedTunnel) redefine(ctx context.Context, cfg config.Tunnel) error {
+	_, err := t.reopen(ctx, nil, cfg)
+	return err
+}
+
+// move replaces the ngrok tunnel like restart does, by one opened on sess.
+// The reference the tunnel holds on its previous session is released, so
+// the caller must have acquired one on sess for the tunnel. Failing to close
+// the previous tunnel does not fail the move, as its session is released.
+func (t *sharedTunnel) move(ctx context.Context, sess *session) error {
+	prev, err := t.reopen(ctx, sess, nil)
+	if prev == nil {
+		return err
+	}
+
+	if err != nil {
+		t.l.Warn("closing ngrok tunnel moved to another session", zap.String("url", t.URL()), zap.Error(err))
+	}
+	releaseSession(prev.key)
+
+	return nil
+}
+
+// reopen replaces the ngrok tunnel by a new one opened on sess with cfg, or
+// on the same session and with the same definition if they are nil. It
+// returns the previous session once the new tunnel is in place.
+func (t *sharedTunnel) reopen(ctx context.Context, sess *session, cfg config.Tunnel) (*session, error) {
+	prev, err := t.relisten(ctx, sess, cfg)
+	if err != nil {
+		return prev, err
+	}
+
+	// the new tunnel may have another URL; the configs are notified without
+	// holding mu, as they lock themselves when releasing the tunnel
+	t.holdersMu.Lock()
+	holders := make([]*Ngrok, 0, len(t.holders))
+	for n := range t.holders {
+		holders = append(holders, n)
+	}
+	t.holdersMu.Unlock()
+
+	for _, n := range holders {
+		n.tunnelReplaced(t)
+	}
+
+	return prev, nil
+}
+
+// relisten opens the tunnel again on sess, or on its session if sess is nil,
+// and swaps it for the current one. It returns the previous session once the
+// new tunnel is in place.
+func (t *sharedTunnel) relisten(ctx context.Context, sess *session, cfg config.Tunnel) (*session, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case <-t.closing:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	prev := t.sess.Load()
+	if sess == nil {
+		sess = prev
+	}
+
+	if cfg != nil {
+		t.cfg = cfg
+	}
+
+	tun, err := sess.Listen(ctx, t.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.replace(tun)
+	t.sess.Store(sess)
+
+	if url := t.URL(); url != t.seriesURL {
+		useTunnelSeries(t.kind, url)
+		releaseTunnelSeries(t.kind, t.seriesURL)
+		t.seriesURL = url
+	}
+
+	return prev, err
+}
+
+// hold records that the config uses the tunnel
+func (t *sharedTunnel) hold(n *Ngrok) {
+	t.holdersMu.Lock()
+	defer t.holdersMu.Unlock()
+
+	t.holders[n] = struct{}{}
+}
+
+// unhold records that the config no longer uses the tunnel
+func (t *sharedTunnel) unhold(n *Ngrok) {
+	t.holdersMu.Lock()
+	defer t.holdersMu.Unlock()
+
+	delete(t.holders, n)
+}
+
+// eventData returns the data of the events describing the tunnel
+func (t *sharedTunnel) eventData(err error) map[string]any {
+	return map[string]any{
+		"url":    t.URL(),
+		"id":     t.ID(),
+		"proto":  t.Proto(),
+		"region": t.session().region,
+		"error":  errString(err),
+	}
+}
+
+// drain waits for the accepted connections to be closed, reporting whether
+// they were before the timeout.
+func (t *sharedTunnel) drain(timeout time.Duration) bool {
+	drained := make(chan struct{})
+	go func() {
+		t.active.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// keyedTunnel is implemented by the tunnels whose marshaled definition does
+// not hold all of their settings, e.g. as they are read from files
+type keyedTunnel interface {
+	// keyMaterial returns the settings missing from the definition
+	keyMaterial() []string
+}
+
+// renewableTunnel is implemented by the tunnels whose definition changes
+// while they are open, e.g. as the certificate they terminate TLS with is
+// renewed
+type renewableTunnel interface {
+	// onRenew sets the function called once the definition changed
+	onRenew(func())
+}
+
+// tunnelKey identifies the tunnels that can be kept across config reloads:
+// the same tunnel definition on the same session. The key is hashed as the
+// tunnel definition may carry credentials.
+func (n *Ngrok) tunnelKey() (string, error) {
+	definition, err := json.Marshal(n.tunnel)
+	if err != nil {
+		return "", fmt.Errorf("encoding tunnel definition: %v", err)
+	}
+
+	var material []byte
+	if keyed, ok := n.tunnel.(keyedTunnel); ok {
+		material, _ = json.Marshal(keyed.keyMaterial())
+	}
+
+	module := n.tunnel.(caddy.Module).CaddyModule().ID
+
+	sum := sha256.Sum256([]byte(n.sessionKey() + "|" + string(module) + "|" + string(definition) + "|" + string(material)))
+	key := hex.EncodeToString(sum[:])
+
+	// a closed tunnel stays in the pool until the configs using it are
+	// unloaded, so the configs loaded afterwards open a new one under a
+	// derived key
+	for {
+		if _, retired := retiredTunnels.Load(key); !retired {
+			return key, nil
+		}
+
+		sum = sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+}
+
+// acquireTunnel opens the tunnel, or reuses the one opened by a previously
+// loaded config if the tunnel definition is unchanged. Every successful call
+// must be paired with a call to releaseTunnel.
+func (n *Ngrok) acquireTunnel() (*sharedTunnel, error) {
+	key, err := n.tunnelKey()
+	if err != nil {
+		return nil, err
+	}
+
+	val, loaded, err := tunnels.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return n.openTunnel(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tun := val.(*sharedTunnel)
+	tun.drainTimeout.Store(int64(n.DrainTimeout))
+	tun.events.Store(n.events)
+
+	if loaded {
+		n.l.Info("ngrok listening", zap.String("address", tun.Addr().String()), zap.Bool("reused", true))
+	}
+
+	return tun, nil
+}
+
+func (n *Ngrok) openTunnel(key string) (*sharedTunnel, error) {
+	sess, err := n.acquireSession()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := n.tunnel.NgrokTunnel()
+
+	tun, err := sess.Listen(n.ctx, cfg)
+	if err != nil {
+		releaseSession(sess.key)
+		return nil, err
+	}
+
+	n.l.Info("ngrok listening", zap.String("address", tun.Addr().String()))
+
+	shared := newSharedTunnel(tun, key, sess, n.l)
+	shared.cfg = cfg
+	shared.kind = n.tunnel.(caddy.Module).CaddyModule().ID.Name()
+	shared.seriesURL = shared.URL()
+	useTunnelSeries(shared.kind, shared.seriesURL)
+	shared.events.Store(n.events)
+	shared.events.emit(eventTunnelStarted, shared.eventData(nil))
+
+	return shared, nil
+}
+
+// sessionTunnels returns the open tunnels of the session with the given key
+func sessionTunnels(sessionKey string) []*sharedTunnel {
+	var tuns []*sharedTunnel
+	for _, tun := range pooledTunnels() {
+		if tun.session().key == sessionKey {
+			tuns = append(tuns, tun)
+		}
+	}
+
+	return tuns
+}
+
+// releaseTunnel drops a reference to the tunnel, closing it if this was the
+// last one.
+func releaseTunnel(key string) error {
+	_, err := tunnels.Delete(key)
+	return err
+}
+
+// restartableTunnel is an ngrok.Tunnel whose underlying tunnel can be
+// replaced without failing the pending Accept calls.
+type restartableTunnel struct {
+	current atomic.Pointer[ngrok.Tunnel]
+
+	// replacing is closed once an expected replacement is done; Accept waits
+	// for it rather than failing when the underlying tunnel is closed first.
+	mu        sync.Mutex
+	replacing chan struct{}
+}
+
+func newRestartableTunnel(tun ngrok.Tunnel) *restartableTunnel {
+	t := new(restartableTunnel)
+	t.current.Store(&tun)
+
+	return t
+}
+
+// tunnel returns the underlying tunnel
+func (t *restartableTunnel) tunnel() ngrok.Tunnel {
+	return *t.current.Load()
+}
+
+// replace swaps the underlying tunnel for tun and closes the previous one
+func (t *restartableTunnel) replace(tun ngrok.Tunnel) error {
+	err := (*t.current.Swap(&tun)).Close()
+	t.endReplace()
+
+	return err
+}
+
+// expectReplace makes Accept wait for the underlying tunnel to be replaced
+// if it is closed in the meantime, e.g. along with its session.
+func (t *restartableTunnel) expectReplace() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.replacing == nil {
+		t.replacing = make(chan struct{})
+	}
+}
+
+// endReplace releases the Accept calls waiting for a replacement
+func (t *restartableTunnel) endReplace() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.replacing != nil {
+		close(t.replacing)
+		t.replacing = nil
+	}
+}
+
+func (t *restartableTunnel) Accept() (net.Conn, error) {
+	for {
+		current := t.current.Load()
+
+		conn, err := (*current).Accept()
+		if err == nil {
+			return conn, nil
+		}
+
+		t.mu.Lock()
+		replacing := t.replacing
+		t.mu.Unlock()
+
+		if replacing != nil {
+			<-replacing
+		}
+
+		if t.current.Load() != current {
+			// the tunnel was replaced
+			continue
+		}
+
+		return nil, err
+	}
+}
+
+func (t *restartableTunnel) Addr() net.Addr {
+	return t.tunnel().Addr()
+}
+
+func (t *restartableTunnel) Close() error {
+	return t.tunnel().Close()
+}
+
+func (t *restartableTunnel) CloseWithContext(ctx context.Context) error {
+	return t.tunnel().CloseWithContext(ctx)
+}
+
+func (t *restartableTunnel) ForwardsTo() string {
+	return t.tunnel().ForwardsTo()
+}
+
+func (t *restartableTunnel) ID() string {
+	return t.tunnel().ID()
+}
+
+func (t *restartableTunnel) Labels() map[string]string {
+	return t.tunnel().Labels()
+}
+
+func (t *restartableTunnel) Metadata() string {
+	return t.tunnel().Metadata()
+}
+
+func (t *restartableTunnel) Proto() string {
+	return t.tunnel().Proto()
+}
+
+func (t *restartableTunnel) Session() ngrok.Session {
+	return t.tunnel().Session()
+}
+
+func (t *restartableTunnel) URL() string {
+	return t.tunnel().URL()
+}
+
+// tunnelView is the listener handed to Caddy for a shared tunnel
+type tunnelView struct {
+	tunnel    *sharedTunnel
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *tunnelView) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.tunnel.stopped:
+		return nil, l.tunnel.acceptErr
+	case conn := <-l.tunnel.conns:
+		return conn, nil
+	}
+}
+
+func (l *tunnelView) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *tunnelView) Addr() net.Addr {
+	return l.tunnel.Addr()
+}
+
+// tunnelConn is a connection accepted from a shared tunnel. It reports when
+// it is closed, so the tunnel can be drained, and counts the bytes going
+// through it.
+type tunnelConn struct {
+	net.Conn
+
+	tunnel    *sharedTunnel
+	metrics   connMetrics
+	closeOnce sync.Once
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.bytesIn.Add(float64(n))
+
+	return n, err
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.bytesOut.Add(float64(n))
+
+	return n, err
+}
+
+func (c *tunnelConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.metrics.active.Dec()
+		c.tunnel.activeConns.Add(-1)
+		c.tunnel.active.Done()
+	})
+
+	return err
+}
+
+// NetConn returns the connection accepted from the ngrok tunnel.
+func (c *tunnelConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// tunnelFromConn returns the shared tunnel conn was accepted from, looking
+// through the connections wrapping it, e.g. by the tls listener wrapper.
+func tunnelFromConn(conn net.Conn) (*sharedTunnel, bool) {
+	for conn != nil {
+		if tc, ok := conn.(*tunnelConn); ok {
+			return tc.tunnel, true
+		}
+
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+
+		conn = wrapper.NetConn()
+	}
+
+	return nil, false
+}
+
+var (
+	_ caddy.Destructor = (*sharedTunnel)(nil)
+	_ ngrok.Tunnel     = (*restartableTunnel)(nil)
+	_ net.Listener     = (*tunnelView)(nil)
+	_ net.Conn         = (*tunnelConn)(nil)
+)
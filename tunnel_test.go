@@ -0,0 +1,145 @@
+package ngroklistener
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+)
+
+// countingSession counts the tunnels opened on it
+type countingSession struct {
+	*fakeSession
+
+	listens atomic.Int32
+	last    atomic.Pointer[fakeTunnel]
+	lastCfg atomic.Value
+}
+
+func (s *countingSession) Listen(ctx context.Context, cfg config.Tunnel) (ngrok.Tunnel, error) {
+	s.listens.Add(1)
+	s.lastCfg.Store(cfg)
+	tun, err := s.fakeSession.Listen(ctx, cfg)
+	s.last.Store(tun.(*fakeTunnel))
+	return tun, err
+}
+
+func withCountingSession(t *testing.T) *countingSession {
+	orig := connect
+	t.Cleanup(func() { connect = orig })
+
+	sess := &countingSession{fakeSession: newFakeSession()}
+	connect = func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		return sess, nil
+	}
+
+	return sess
+}
+
+func TestTunnelKeptAcrossReloads(t *testing.T) {
+	sess := withCountingSession(t)
+
+	oldCfg := &Ngrok{AuthToken: "reload-test", TunnelRaw: []byte(`{"type":"http","domain":"foo.ngrok.app"}`)}
+	unloadOld := provisionNgrok(t, oldCfg)
+	oldLn := oldCfg.WrapListener(nil)
+	tun := sess.last.Load()
+
+	// reload with the same tunnel definition
+	newCfg := &Ngrok{AuthToken: "reload-test", TunnelRaw: []byte(`{"type":"http","domain":"foo.ngrok.app"}`)}
+	unloadNew := provisionNgrok(t, newCfg)
+	newLn := newCfg.WrapListener(nil)
+
+	require.Nil(t, oldLn.Close())
+	unloadOld()
+
+	require.EqualValues(t, 1, sess.listens.Load())
+	require.Never(t, tun.isClosed, 50*time.Millisecond, time.Millisecond)
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := newLn.Accept()
+		accepted <- conn
+	}()
+	_, client := tun.dial()
+	defer client.Close()
+	conn := <-accepted
+	require.NotNil(t, conn)
+	require.Nil(t, conn.Close())
+
+	// reload with a changed tunnel definition
+	changedCfg := &Ngrok{AuthToken: "reload-test", TunnelRaw: []byte(`{"type":"http","domain":"bar.ngrok.app"}`)}
+	provisionNgrok(t, changedCfg)
+	unloadNew()
+
+	require.EqualValues(t, 2, sess.listens.Load())
+	require.Eventually(t, tun.isClosed, time.Second, time.Millisecond)
+	require.False(t, sess.isClosed())
+}
+
+func TestTunnelViewClose(t *testing.T) {
+	withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "view-close-test"}
+	provisionNgrok(t, n)
+
+	ln := n.WrapListener(nil)
+	require.Equal(t, "fake.ngrok.app:443", ln.Addr().String())
+	require.Nil(t, ln.Close())
+
+	_, err := ln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestTunnelCleanupDrains(t *testing.T) {
+	sess := withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "drain-test", DrainTimeout: caddy.Duration(time.Second)}
+	unload := provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+	tun := sess.last.Load()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	_, client := tun.dial()
+	defer client.Close()
+	conn := <-accepted
+
+	cleanedUp := make(chan struct{})
+	go func() {
+		unload()
+		close(cleanedUp)
+	}()
+
+	require.Eventually(t, tun.isClosed, time.Second, time.Millisecond)
+	require.Never(t, func() bool { return isDone(cleanedUp) }, 50*time.Millisecond, time.Millisecond)
+	require.False(t, sess.isClosed())
+
+	require.Nil(t, conn.Close())
+	require.Eventually(t, func() bool { return isDone(cleanedUp) }, time.Second, time.Millisecond)
+	require.True(t, sess.isClosed())
+}
+
+func TestTunnelCleanupDrainTimeout(t *testing.T) {
+	sess := withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "drain-timeout-test", DrainTimeout: caddy.Duration(10 * time.Millisecond)}
+	unload := provisionNgrok(t, n)
+	ln := n.WrapListener(nil)
+	tun := sess.last.Load()
+
+	go ln.Accept()
+	_, client := tun.dial()
+	defer client.Close()
+
+	unload()
+	require.True(t, sess.isClosed())
+}
@@ -0,0 +1,128 @@
+package ngroklistener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const (
+	urlFileFormatText = "text"
+	urlFileFormatJSON = "json"
+)
+
+// urlFiles holds the URL files written by the loaded configs, keyed by path,
+// so a file is only removed once no loaded config writes it anymore.
+var urlFiles = caddy.NewUsagePool()
+
+// urlFile is a file holding the public URL of a tunnel
+type urlFile struct {
+	path string
+}
+
+// Destruct implements caddy.Destructor; it removes the file once the last
+// config writing it is unloaded.
+func (f *urlFile) Destruct() error {
+	err := os.Remove(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// urlFileContent is the JSON document written to the URL file
+type urlFileContent struct {
+	URL      string            `json:"url"`
+	ID       string            `json:"id"`
+	Proto    string            `json:"proto"`
+	Region   string            `json:"region,omitempty"`
+	Metadata string            `json:"metadata,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+// writeURLFile writes the URL of tun to the configured url_file, replacing
+// the file atomically so readers never see it partially written.
+func (n *Ngrok) writeURLFile(tun *sharedTunnel) error {
+	if n.URLFile == "" {
+		return nil
+	}
+
+	url := tun.URL()
+	if url == "" {
+		// labeled tunnels have no URL
+		url = tun.Addr().String()
+	}
+
+	var content []byte
+	switch n.URLFileFormat {
+	case urlFileFormatJSON:
+		var err error
+		content, err = json.MarshalIndent(urlFileContent{
+			URL:      url,
+			ID:       tun.ID(),
+			Proto:    tun.Proto(),
+			Region:   tun.session().region,
+			Metadata: tun.Metadata(),
+			Labels:   tun.Labels(),
+		}, "", "\t")
+		if err != nil {
+			return fmt.Errorf("encoding url_file: %v", err)
+		}
+	default:
+		content = []byte(url)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(n.URLFile), "."+filepath.Base(n.URLFile)+".*")
+	if err != nil {
+		return fmt.Errorf("writing url_file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing url_file: %v", err)
+	}
+
+	if err = tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing url_file: %v", err)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("writing url_file: %v", err)
+	}
+
+	// hold the file before it shows up, so the config being replaced does not
+	// remove it on cleanup
+	if !n.urlFileHeld {
+		urlFiles.LoadOrStore(n.URLFile, &urlFile{path: n.URLFile})
+		n.urlFileHeld = true
+	}
+
+	if err = os.Rename(tmp.Name(), n.URLFile); err != nil {
+		return fmt.Errorf("writing url_file: %v", err)
+	}
+
+	return nil
+}
+
+// releaseURLFile drops the reference of n to its URL file, removing the file
+// if no other loaded config writes it.
+func (n *Ngrok) releaseURLFile() error {
+	if !n.urlFileHeld {
+		return nil
+	}
+
+	n.urlFileHeld = false
+	_, err := urlFiles.Delete(n.URLFile)
+
+	return err
+}
+
+var _ caddy.Destructor = (*urlFile)(nil)
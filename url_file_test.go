@@ -0,0 +1,196 @@
+package ngroklistener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+)
+
+func TestNgrokURLFileParse(t *testing.T) {
+	cases := genericNgrokTestCases[*Ngrok]{
+		{
+			name: "absent",
+			caddyInput: `ngrok {
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Empty(t, actual.URLFile)
+				require.Empty(t, actual.URLFileFormat)
+			},
+		},
+		{
+			name: "set url_file",
+			caddyInput: `ngrok {
+				url_file ngrok-url-file-parse.txt
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.URLFile, "ngrok-url-file-parse.txt")
+				require.Empty(t, actual.URLFileFormat)
+			},
+		},
+		{
+			name: "set url_file json",
+			caddyInput: `ngrok {
+				url_file ngrok-url-file-parse.json json
+			}`,
+			expectConfig: func(t *testing.T, actual *Ngrok) {
+				require.Equal(t, actual.URLFile, "ngrok-url-file-parse.json")
+				require.Equal(t, actual.URLFileFormat, "json")
+			},
+		},
+		{
+			name: "url_file-no-arg",
+			caddyInput: `ngrok {
+				url_file
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "url_file-unrecognized-format",
+			caddyInput: `ngrok {
+				url_file ngrok-url.yaml yaml
+			}`,
+			expectUnmarshalErr: true,
+		},
+		{
+			name: "url_file-too-many-arg",
+			caddyInput: `ngrok {
+				url_file ngrok-url.json json extra
+			}`,
+			expectUnmarshalErr: true,
+		},
+	}
+	cases.runAll(t)
+}
+
+func TestNgrokURLFile(t *testing.T) {
+	withCountingSession(t)
+
+	path := filepath.Join(t.TempDir(), "ngrok-url")
+
+	n := &Ngrok{AuthToken: "url-file-test", URLFile: path}
+	unload := provisionNgrok(t, n)
+
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "https://fake.ngrok.app\n", string(content))
+
+	// a reload keeps the file
+	reloaded := &Ngrok{AuthToken: "url-file-test", URLFile: path}
+	unloadReloaded := provisionNgrok(t, reloaded)
+	unload()
+
+	require.FileExists(t, path)
+
+	unloadReloaded()
+	require.NoFileExists(t, path)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.Nil(t, err)
+	require.Empty(t, entries)
+}
+
+func TestNgrokURLFileJSON(t *testing.T) {
+	withCountingSession(t)
+
+	path := filepath.Join(t.TempDir(), "ngrok-url.json")
+
+	n := &Ngrok{AuthToken: "url-file-json-test", Region: "eu", URLFile: path, URLFileFormat: "json"}
+	provisionNgrok(t, n)
+
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+
+	var actual urlFileContent
+	require.Nil(t, json.Unmarshal(content, &actual))
+	require.Equal(t, urlFileContent{
+		URL:    "https://fake.ngrok.app",
+		ID:     "tn_fake",
+		Proto:  "https",
+		Region: "eu",
+	}, actual)
+}
+
+func TestNgrokURLFileUnwritable(t *testing.T) {
+	withCountingSession(t)
+
+	n := &Ngrok{AuthToken: "url-file-unwritable-test", URLFile: filepath.Join(t.TempDir(), "missing", "ngrok-url")}
+	err := n.Provision(newTestContext(t))
+	require.ErrorContains(t, err, "writing url_file")
+	require.Nil(t, n.Cleanup())
+}
+
+// urlSession opens tunnels with a new URL each time
+type urlSession struct {
+	*fakeSession
+
+	listens atomic.Int32
+	last    atomic.Pointer[urlTunnel]
+}
+
+func (s *urlSession) Listen(ctx context.Context, cfg config.Tunnel) (ngrok.Tunnel, error) {
+	tun, err := s.fakeSession.Listen(ctx, cfg)
+	n := s.listens.Add(1)
+	last := &urlTunnel{fakeTunnel: tun.(*fakeTunnel), url: fmt.Sprintf("https://%d.ngrok.app", n), proto: "https"}
+	s.last.Store(last)
+	return last, err
+}
+
+func withURLSession(t *testing.T) *urlSession {
+	orig := connect
+	t.Cleanup(func() { connect = orig })
+
+	sess := &urlSession{fakeSession: newFakeSession()}
+	connect = func(context.Context, ...ngrok.ConnectOption) (ngrok.Session, error) {
+		return sess, nil
+	}
+
+	return sess
+}
+
+func TestNgrokURLFileRestart(t *testing.T) {
+	withURLSession(t)
+
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+
+	n := &Ngrok{AuthToken: "url-file-restart-test", URLFile: first}
+	unload := provisionNgrok(t, n)
+
+	// another config holding the same tunnel
+	reloaded := &Ngrok{AuthToken: "url-file-restart-test", URLFile: second}
+	provisionNgrok(t, reloaded)
+	require.Same(t, n.shared, reloaded.shared)
+
+	for _, path := range []string{first, second} {
+		content, err := os.ReadFile(path)
+		require.Nil(t, err)
+		require.Equal(t, "https://1.ngrok.app\n", string(content))
+	}
+
+	// the tunnel is restarted with another URL
+	require.Nil(t, n.shared.restart(context.Background()))
+
+	for _, path := range []string{first, second} {
+		content, err := os.ReadFile(path)
+		require.Nil(t, err)
+		require.Equal(t, "https://2.ngrok.app\n", string(content))
+	}
+
+	// the file of an unloaded config is not written again
+	unload()
+	require.NoFileExists(t, first)
+	require.Nil(t, reloaded.shared.restart(context.Background()))
+	require.NoFileExists(t, first)
+
+	content, err := os.ReadFile(second)
+	require.Nil(t, err)
+	require.Equal(t, "https://3.ngrok.app\n", string(content))
+}
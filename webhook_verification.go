@@ -2,6 +2,7 @@ package ngroklistener
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/caddyserver/caddy/v2"
@@ -20,6 +21,12 @@ func (wv *webhookVerification) Provision(caddy.Context) error {
 
 	wv.doReplace()
 
+	secret, err := resolveSecret(wv.Secret)
+	if err != nil {
+		return fmt.Errorf("resolving webhook_verification secret: %v", err)
+	}
+	wv.Secret = secret
+
 	if strings.TrimSpace(wv.Provider) == "" {
 		return errors.New("webhookVerification `provider` cannot be empty string")
 	}
@@ -39,8 +46,6 @@ func (wv *webhookVerification) doReplace() {
 
 	wv.Provider = repl.ReplaceKnown(wv.Provider, "")
 
-	wv.Secret = repl.ReplaceKnown(wv.Secret, "")
-
 }
 
 func (wv *webhookVerification) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {